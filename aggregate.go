@@ -0,0 +1,88 @@
+package main
+
+import "time"
+
+// readingMean accumulates the readings from a device over an aggregation
+// window. Temperature, the raw temperature, humidity and the probe
+// temperatures are averaged over the readings that carried them; every
+// other field takes its latest value.
+type readingMean struct {
+	last     Reading
+	n        int
+	temp     meanSum
+	rawTemp  meanSum
+	humidity meanSum
+	probes   []meanSum
+}
+
+type meanSum struct {
+	sum float64
+	n   int
+}
+
+func (m *meanSum) add(v *float64) {
+	if v != nil {
+		m.sum += *v
+		m.n++
+	}
+}
+
+// mean returns the mean, or nil if no values were added.
+func (m meanSum) mean() *float64 {
+	if m.n == 0 {
+		return nil
+	}
+	v := m.sum / float64(m.n)
+	return &v
+}
+
+func (a *readingMean) add(r Reading) {
+	a.last = r
+	a.n++
+	a.temp.add(r.Temperature)
+	a.rawTemp.add(r.RawTemperature)
+	a.humidity.add(r.Humidity)
+	for i := range r.Probes {
+		if i == len(a.probes) {
+			a.probes = append(a.probes, meanSum{})
+		}
+		a.probes[i].add(&r.Probes[i])
+	}
+}
+
+// mean returns the aggregated reading, or false if there were no readings
+// in the window.
+func (a readingMean) mean() (Reading, bool) {
+	if a.n == 0 {
+		return Reading{}, false
+	}
+	r := a.last
+	if r.Temperature != nil {
+		r.Temperature = a.temp.mean()
+	}
+	if r.RawTemperature != nil {
+		r.RawTemperature = a.rawTemp.mean()
+	}
+	if r.Humidity != nil {
+		r.Humidity = a.humidity.mean()
+	}
+	if len(r.Probes) > 0 {
+		probes := make([]float64, len(r.Probes))
+		for i := range probes {
+			probes[i] = *a.probes[i].mean()
+		}
+		r.Probes = probes
+	}
+	return r, true
+}
+
+// emitAggregates exports the mean reading of every device heard from
+// since the last aggregation window closed, and starts a new window.
+func (s *state) emitAggregates(now time.Time) {
+	for id, cur := range s.updates {
+		if r, ok := cur.aggregate.mean(); ok {
+			s.emit(id, cur, r, now)
+			cur.aggregate = readingMean{}
+		}
+	}
+}
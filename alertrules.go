@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultStaleAfter is the stale rule window for devices without a
+// configured timeout.
+const defaultStaleAfter = 15 * time.Minute
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// alertRules returns Prometheus alerting rules for each tracked device:
+// stale after its configured timeout, low battery, and temperature out of
+// its configured range when it has one.
+func (s *state) alertRules() ruleFile {
+	ids := make([]string, 0, len(s.updates))
+	for id := range s.updates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	group := ruleGroup{Name: "btl"}
+	for _, id := range ids {
+		dev := s.cfg.devices[id]
+		sel := fmt.Sprintf(`{unit=%q}`, id)
+		name := s.cfg.displayName(id)
+
+		stale := dev.Timeout
+		if stale <= 0 {
+			stale = defaultStaleAfter
+		}
+		group.Rules = append(group.Rules, rule{
+			Alert:       "BTLDeviceStale",
+			Expr:        fmt.Sprintf("increase(btl_sensorbug_readings_total%s[%s]) == 0", sel, promDuration(stale)),
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": fmt.Sprintf("%s has not been seen for %v", name, stale)},
+		})
+		group.Rules = append(group.Rules, rule{
+			Alert:       "BTLBatteryLow",
+			Expr:        fmt.Sprintf("btl_sensorbug_battery_percent%s < %d", sel, s.cfg.alertBattery),
+			For:         "1h",
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": fmt.Sprintf("%s battery below %d%%", name, s.cfg.alertBattery)},
+		})
+		if dev.TempMin != nil || dev.TempMax != nil {
+			var expr string
+			switch {
+			case dev.TempMin != nil && dev.TempMax != nil:
+				expr = fmt.Sprintf("btl_sensorbug_temperature_c%s < %g or btl_sensorbug_temperature_c%s > %g", sel, *dev.TempMin, sel, *dev.TempMax)
+			case dev.TempMin != nil:
+				expr = fmt.Sprintf("btl_sensorbug_temperature_c%s < %g", sel, *dev.TempMin)
+			default:
+				expr = fmt.Sprintf("btl_sensorbug_temperature_c%s > %g", sel, *dev.TempMax)
+			}
+			group.Rules = append(group.Rules, rule{
+				Alert:       "BTLTemperatureOutOfRange",
+				Expr:        expr,
+				For:         "5m",
+				Labels:      map[string]string{"severity": "critical"},
+				Annotations: map[string]string{"summary": fmt.Sprintf("%s temperature out of range", name)},
+			})
+		}
+	}
+	return ruleFile{Groups: []ruleGroup{group}}
+}
+
+// promDuration formats a duration in whole seconds, as Prometheus
+// expects.
+func promDuration(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d.Round(time.Second)/time.Second))
+}
+
+// handleAlertRules returns alerting rules for the tracked devices, to be
+// copied into the Prometheus configuration.
+func (s *state) handleAlertRules(w http.ResponseWriter, req *http.Request) {
+	s.mut.Lock()
+	rules := s.alertRules()
+	s.mut.Unlock()
+
+	bs, err := yaml.Marshal(rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(bs)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// anonymizer replaces device IDs with a keyed hash, so that metrics and
+// logs stay consistent per device without disclosing the real IDs. With a
+// random key the hashes change on every run. A nil anonymizer leaves IDs
+// unchanged.
+type anonymizer struct {
+	key     []byte
+	mapFile string // where to record hash to ID mappings, if set
+
+	mut  sync.Mutex
+	seen map[string]string
+}
+
+func newAnonymizer(key, mapFile string) (*anonymizer, error) {
+	a := &anonymizer{
+		key:     []byte(key),
+		mapFile: mapFile,
+		seen:    make(map[string]string),
+	}
+	if key == "" {
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// id returns the anonymized form of the device ID.
+func (a *anonymizer) id(real string) string {
+	if a == nil {
+		return real
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if anon, ok := a.seen[real]; ok {
+		return anon
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(real))
+	anon := hex.EncodeToString(mac.Sum(nil))[:12]
+	a.seen[real] = anon
+	if a.mapFile != "" {
+		if err := appendLine(a.mapFile, fmt.Sprintf("%s %s\n", anon, real)); err != nil {
+			log.Println("Anonymize map:", err)
+		}
+	}
+	return anon
+}
+
+// known returns the anonymized form of a device ID that has already been
+// through id, without hashing or recording new ones.
+func (a *anonymizer) known(real string) (string, bool) {
+	if a == nil {
+		return real, true
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	anon, ok := a.seen[real]
+	return anon, ok
+}
+
+// devices returns the device configuration keyed by anonymized ID.
+func (a *anonymizer) devices(devices map[string]deviceConfig) map[string]deviceConfig {
+	if a == nil || devices == nil {
+		return devices
+	}
+	res := make(map[string]deviceConfig, len(devices))
+	for id, dev := range devices {
+		res[a.id(id)] = dev
+	}
+	return res
+}
+
+func appendLine(path, line string) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.WriteString(line); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
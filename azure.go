@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// azureAPIVersion is the IoT Hub API version given when connecting.
+const azureAPIVersion = "2021-04-12"
+
+// azureIoTConfig is the connection information for Azure IoT Hub, which
+// we connect to as a single device, the gateway, by its MQTT interface.
+type azureIoTConfig struct {
+	hostName string // <hub>.azure-devices.net
+	deviceID string
+	key      []byte // the device's shared access key
+	tokenTTL time.Duration
+}
+
+// parseAzureConnectionString parses a device connection string as shown in
+// the Azure portal: HostName=...;DeviceId=...;SharedAccessKey=...
+func parseAzureConnectionString(s string, tokenTTL time.Duration) (azureIoTConfig, error) {
+	cfg := azureIoTConfig{tokenTTL: tokenTTL}
+	for _, part := range strings.Split(s, ";") {
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := part[:i], part[i+1:]
+		switch key {
+		case "HostName":
+			cfg.hostName = value
+		case "DeviceId":
+			cfg.deviceID = value
+		case "SharedAccessKey":
+			bs, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return cfg, fmt.Errorf("connection string: SharedAccessKey: %w", err)
+			}
+			cfg.key = bs
+		}
+	}
+	switch {
+	case cfg.hostName == "":
+		return cfg, fmt.Errorf("connection string: missing HostName")
+	case cfg.deviceID == "":
+		return cfg, fmt.Errorf("connection string: missing DeviceId")
+	case cfg.key == nil:
+		return cfg, fmt.Errorf("connection string: missing SharedAccessKey (only symmetric key authentication is supported)")
+	}
+	if cfg.tokenTTL <= 0 {
+		return cfg, fmt.Errorf("token lifetime must be positive")
+	}
+	return cfg, nil
+}
+
+// sasToken returns a shared access signature token for the device, valid
+// until the expiry.
+func (c azureIoTConfig) sasToken(expiry time.Time) string {
+	resource := url.QueryEscape(c.hostName + "/devices/" + c.deviceID)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(resource + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s", resource, url.QueryEscape(sig), se)
+}
+
+// newAzureIoTSink returns a sink sending each sample as a device-to-cloud
+// message from the gateway device, with the sensor's ID in the unit
+// message property. The hub closes the connection when the SAS token
+// expires; a fresh token is made for every connection, so the automatic
+// reconnect also renews it.
+func newAzureIoTSink(cfg azureIoTConfig) (*mqttSink, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker("ssl://" + net.JoinHostPort(cfg.hostName, "8883")).
+		SetClientID(cfg.deviceID).
+		SetProtocolVersion(4). // IoT Hub speaks MQTT 3.1.1 only
+		SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}).
+		SetCredentialsProvider(func() (string, string) {
+			user := cfg.hostName + "/" + cfg.deviceID + "/?api-version=" + azureAPIVersion
+			return user, cfg.sasToken(time.Now().Add(cfg.tokenTTL))
+		})
+	topic := "devices/" + cfg.deviceID + "/messages/events/unit={{urlquery .Device}}"
+	return newMQTTSink(opts, topic, false)
+}
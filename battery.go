@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// batterySampleInterval is the minimum time between recorded battery
+	// samples, and batterySamples the number of samples kept, giving about
+	// a week of history.
+	batterySampleInterval = time.Hour
+	batterySamples        = 168
+	// batteryMinSpan is the minimum time covered by the history before we
+	// estimate a trend.
+	batteryMinSpan = 6 * time.Hour
+)
+
+type batterySample struct {
+	when    time.Time
+	percent float64
+}
+
+// batteryHistory is a ring buffer of battery samples for a device.
+type batteryHistory struct {
+	samples []batterySample
+	next    int
+}
+
+// add records a sample, unless one was recorded less than the sample
+// interval ago. It returns true if the sample was recorded.
+func (h *batteryHistory) add(when time.Time, percent float64) bool {
+	if len(h.samples) > 0 {
+		last := h.samples[(h.next+len(h.samples)-1)%len(h.samples)]
+		if when.Sub(last.when) < batterySampleInterval {
+			return false
+		}
+	}
+	if len(h.samples) < batterySamples {
+		h.samples = append(h.samples, batterySample{when, percent})
+		return true
+	}
+	h.samples[h.next] = batterySample{when, percent}
+	h.next = (h.next + 1) % len(h.samples)
+	return true
+}
+
+// ratePerDay returns the least squares slope of battery percent over time,
+// in percent per day. It returns false if there is not yet enough history.
+func (h *batteryHistory) ratePerDay() (float64, bool) {
+	if len(h.samples) < 2 {
+		return 0, false
+	}
+	first := h.samples[h.next%len(h.samples)].when
+	var sx, sy, sxx, sxy, maxX float64
+	for _, s := range h.samples {
+		x := s.when.Sub(first).Hours() / 24
+		sx += x
+		sy += s.percent
+		sxx += x * x
+		sxy += x * s.percent
+		if x > maxX {
+			maxX = x
+		}
+	}
+	if maxX*24 < batteryMinSpan.Hours() {
+		return 0, false
+	}
+	n := float64(len(h.samples))
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return 0, false
+	}
+	return (n*sxy - sx*sy) / den, true
+}
+
+// ordered returns the samples oldest first.
+func (h *batteryHistory) ordered() []batterySample {
+	res := make([]batterySample, 0, len(h.samples))
+	res = append(res, h.samples[h.next:]...)
+	return append(res, h.samples[:h.next]...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// clockStepThreshold is how far the wall clock must move relative to the
+// monotonic clock between two discoveries to count as a step.
+const clockStepThreshold = time.Second
+
+var clockSkew = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "btl",
+	Name:      "clock_skew_events_total",
+	Help:      "Number of times the system clock was seen to step, or an interval came out negative.",
+})
+
+// monoBase is the time at startup. Times kept atomically are stored as
+// nanoseconds since monoBase rather than since the Unix epoch, so that
+// they keep their monotonic clock reading when converted back and
+// intervals computed from them aren't thrown off by the wall clock being
+// stepped, as NTP does on a Raspberry Pi shortly after boot.
+var monoBase = time.Now()
+
+func monoNanos(t time.Time) int64 {
+	return int64(t.Sub(monoBase))
+}
+
+func monoTime(ns int64) time.Time {
+	return monoBase.Add(time.Duration(ns))
+}
+
+// checkClock compares the wall clock and monotonic clock time elapsed
+// between two discoveries and warns when the wall clock stepped.
+// Intervals between times read in this process use the monotonic clock and
+// are unaffected; times restored from the state file only have the wall
+// clock and are shifted by the step.
+func checkClock(prev, now time.Time) {
+	if prev.IsZero() {
+		return
+	}
+	step := now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+	if step > -clockStepThreshold && step < clockStepThreshold {
+		return
+	}
+	clockSkew.Inc()
+	if step < 0 {
+		log.Printf("Warning: system clock stepped back by %v\n", -step)
+	} else {
+		log.Printf("Warning: system clock stepped forward by %v\n", step)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// A temperature change of collisionTempJump or an RSSI change of
+	// collisionRSSIJump between samples less than collisionJumpWindow
+	// apart is implausible for a single sensor. collisionJumps such
+	// jumps within collisionWindow suggest two sensors sharing an ID,
+	// their samples interleaved.
+	collisionTempJump   = 3.0 // °C
+	collisionRSSIJump   = 30  // dB
+	collisionJumpWindow = 30 * time.Second
+	collisionJumps      = 3
+	collisionWindow     = 10 * time.Minute
+)
+
+// collisionDetector looks for signs of several physical devices reporting
+// the same ID in the samples from a device. Each collision is reported
+// once per window, not once per jump.
+type collisionDetector struct {
+	seen     bool
+	last     time.Time
+	temp     *float64
+	rssi     int
+	jumps    []time.Time
+	reported time.Time
+}
+
+// observe records a sample and returns true if it completes a suspected
+// collision.
+func (c *collisionDetector) observe(now time.Time, temp *float64, rssi int) bool {
+	jump := false
+	if c.seen && now.Sub(c.last) < collisionJumpWindow {
+		if temp != nil && c.temp != nil && math.Abs(*temp-*c.temp) >= collisionTempJump {
+			jump = true
+		}
+		if abs(rssi-c.rssi) >= collisionRSSIJump {
+			jump = true
+		}
+	}
+	c.seen = true
+	c.last = now
+	c.temp = temp
+	c.rssi = rssi
+	if !jump {
+		return false
+	}
+
+	recent := c.jumps[:0]
+	for _, t := range c.jumps {
+		if now.Sub(t) < collisionWindow {
+			recent = append(recent, t)
+		}
+	}
+	c.jumps = append(recent, now)
+	if len(c.jumps) < collisionJumps || now.Sub(c.reported) < collisionWindow {
+		return false
+	}
+	c.reported = now
+	return true
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
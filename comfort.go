@@ -0,0 +1,31 @@
+package main
+
+import "math"
+
+// comfortConfig is the ideal temperature and humidity and how far from
+// them readings may stray while still being reasonably comfortable.
+type comfortConfig struct {
+	temp, tempTolerance float64 // °C
+	rh, rhTolerance     float64 // %
+}
+
+var defaultComfort = comfortConfig{temp: 21, tempTolerance: 3, rh: 45, rhTolerance: 15}
+
+// comfortScore rates a temperature and relative humidity from 0 to 100.
+// Each is scored separately, falling linearly from 100 at the ideal value
+// to 50 at the tolerance and 0 at twice the tolerance, and the result is
+// the lower of the two scores.
+func comfortScore(temp, rh float64, c comfortConfig) float64 {
+	return math.Min(comfortPart(temp, c.temp, c.tempTolerance), comfortPart(rh, c.rh, c.rhTolerance))
+}
+
+func comfortPart(v, ideal, tolerance float64) float64 {
+	if tolerance <= 0 {
+		if v == ideal {
+			return 100
+		}
+		return 0
+	}
+	score := 100 - 50*math.Abs(v-ideal)/tolerance
+	return math.Max(score, 0)
+}
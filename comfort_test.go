@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestComfortScore(t *testing.T) {
+	c := comfortConfig{temp: 21, tempTolerance: 2, rh: 45, rhTolerance: 10}
+
+	cases := []struct {
+		temp, rh float64
+		score    float64
+	}{
+		{21, 45, 100},
+		{23, 45, 50}, // temperature at the tolerance
+		{19, 45, 50}, // on either side
+		{21, 35, 50}, // humidity at the tolerance
+		{22, 40, 75}, // the lower score counts
+		{25, 45, 0},  // twice the tolerance
+		{30, 45, 0},  // clamped
+		{21, 100, 0}, // clamped
+		{22, 47.5, 75},
+	}
+
+	for _, tc := range cases {
+		if got := comfortScore(tc.temp, tc.rh, c); got != tc.score {
+			t.Errorf("comfortScore(%v, %v) = %v, expected %v", tc.temp, tc.rh, got, tc.score)
+		}
+	}
+}
+
+func TestComfortScoreZeroTolerance(t *testing.T) {
+	c := comfortConfig{temp: 21, rh: 45}
+	if got := comfortScore(21, 45, c); got != 100 {
+		t.Errorf("got %v at the ideal values, expected 100", got)
+	}
+	if got := comfortScore(21.1, 45, c); got != 0 {
+		t.Errorf("got %v off the ideal values, expected 0", got)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/photostorm/gatt"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the optional YAML configuration file, holding settings
+// that apply to individual devices.
+type configFile struct {
+	Devices map[string]deviceConfig `yaml:"devices"`
+	// Sinks holds optional filters for the sinks, keyed by sink name.
+	Sinks map[string]sinkFilter `yaml:"sinks"`
+}
+
+// deviceConfig is the configuration for a single device, keyed by device
+// ID in the config file.
+type deviceConfig struct {
+	// Name is a friendly name for the device, used in log messages.
+	Name string `yaml:"name"`
+	// Group is an optional zone or group name, exported as the group
+	// label on the reading metrics with -labels group, so that devices
+	// can be aggregated.
+	Group string `yaml:"group"`
+	// Timeout is how long the device may go without being seen before
+	// it is considered overdue, or with -overdue-on temperature, without
+	// sending a temperature. Zero disables the check.
+	Timeout time.Duration `yaml:"timeout"`
+	// TempOffset is added to the device's temperature readings, to
+	// calibrate it against a reference.
+	TempOffset float64 `yaml:"tempOffset"`
+	// TempMin and TempMax, if set, are the temperature range used for the
+	// out of range rule in /alerts.yaml, and outside which the device's
+	// status is critical.
+	TempMin *float64 `yaml:"tempMin"`
+	TempMax *float64 `yaml:"tempMax"`
+	// TempWarnMin and TempWarnMax, if set, are the expected temperature
+	// range, outside which the device's status is warn.
+	TempWarnMin *float64 `yaml:"tempWarnMin"`
+	TempWarnMax *float64 `yaml:"tempWarnMax"`
+	// Poll, if set, enables periodically connecting to the device to
+	// read GATT characteristics.
+	Poll *pollConfig `yaml:"poll"`
+}
+
+func loadConfigFile(path string) (configFile, error) {
+	var cfg configFile
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.UnmarshalStrict(bs, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if problems := cfg.problems(); len(problems) > 0 {
+		return cfg, fmt.Errorf("%s: %s", path, problems[0])
+	}
+	return cfg, nil
+}
+
+// problems returns everything wrong with the config, in device order and
+// then in sink order.
+func (c configFile) problems() []string {
+	ids := make([]string, 0, len(c.Devices))
+	for id := range c.Devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var problems []string
+	for _, id := range ids {
+		dev := c.Devices[id]
+		add := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("device %s: ", id)+fmt.Sprintf(format, args...))
+		}
+		if dev.Timeout < 0 {
+			add("negative timeout")
+		}
+		if dev.TempMin != nil && dev.TempMax != nil && *dev.TempMin > *dev.TempMax {
+			add("tempMin above tempMax")
+		}
+		if dev.TempWarnMin != nil && dev.TempWarnMax != nil && *dev.TempWarnMin > *dev.TempWarnMax {
+			add("tempWarnMin above tempWarnMax")
+		}
+		if dev.TempWarnMin != nil && dev.TempMin != nil && *dev.TempWarnMin < *dev.TempMin {
+			add("tempWarnMin below tempMin")
+		}
+		if dev.TempWarnMax != nil && dev.TempMax != nil && *dev.TempWarnMax > *dev.TempMax {
+			add("tempWarnMax above tempMax")
+		}
+		if dev.Poll != nil {
+			if _, err := parsePollConfig(*dev.Poll); err != nil {
+				add("%v", err)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(c.Sinks))
+	for name := range c.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !contains(sinkNames, name) {
+			problems = append(problems, fmt.Sprintf("sink %s: unknown sink", name))
+			continue
+		}
+		if _, err := c.Sinks[name].parse(nil); err != nil {
+			problems = append(problems, fmt.Sprintf("sink %s: %v", name, err))
+		}
+	}
+	return problems
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfig validates the config file, reporting every problem found
+// along with the given problems with the command line, and returns the
+// process exit code.
+func checkConfig(path string, flagProblems []string) int {
+	var problems []string
+	var cfg configFile
+	bs, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = yaml.UnmarshalStrict(bs, &cfg)
+	}
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		problems = cfg.problems()
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", path, p)
+	}
+	for _, p := range flagProblems {
+		fmt.Printf("flags: %s\n", p)
+	}
+	if len(problems)+len(flagProblems) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: OK, %d devices\n", path, len(cfg.Devices))
+	return 0
+}
+
+// displayName returns the device ID along with the friendly name, if one
+// is configured.
+func (c config) displayName(id string) string {
+	if name := c.devices[id].Name; name != "" {
+		return fmt.Sprintf("%s (%s)", name, id)
+	}
+	return id
+}
+
+// name returns the friendly name of a device: the configured name, or with
+// -advertised-names the last advertised name, or empty.
+func (s *state) name(id string) string {
+	if name := s.cfg.devices[id].Name; name != "" {
+		return name
+	}
+	return s.advNames[id]
+}
+
+// cacheAdvertisedName remembers the local name in the advertisement.
+// Advertisements and scan responses arrive separately and usually only the
+// scan response carries the name, so keeping the last one seen means the
+// name doesn't come and go from one packet to the next. Only SensorBugs and
+// devices we already track are cached, to keep the map, and with
+// -anonymize the anonymizer, from filling up with every device in range.
+func (s *state) cacheAdvertisedName(rawID string, a *gatt.Advertisement) {
+	if isSensorBug(a.ManufacturerData) {
+		s.advNames[s.cfg.anon.id(rawID)] = a.LocalName
+		return
+	}
+	// A tracked device has been anonymized already
+	if id, ok := s.cfg.anon.known(rawID); ok {
+		if _, ok := s.updates[id]; ok {
+			s.advNames[id] = a.LocalName
+		}
+	}
+}
+
+// saveDeviceName sets the name of a device in the config file, leaving the
+// rest of the file as is apart from comments and formatting, which are
+// lost in the round trip.
+func saveDeviceName(path, id, name string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	devices, _ := mapValue(doc, "devices").(yaml.MapSlice)
+	dev, _ := mapValue(devices, id).(yaml.MapSlice)
+	dev = setMapValue(dev, "name", name)
+	devices = setMapValue(devices, id, dev)
+	doc = setMapValue(doc, "devices", devices)
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, out)
+}
+
+func mapValue(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+func setMapValue(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// debugState is everything we know, for /debug/state. Unlike /devices it
+// follows the internal structures rather than being a stable interface.
+type debugState struct {
+	Started        time.Time                  `json:"started"`
+	LastAny        time.Time                  `json:"lastAdvertisement"`
+	LastScrape     time.Time                  `json:"lastScrape"`
+	Flags          map[string]string          `json:"flags"`
+	DiscoveryQueue int                        `json:"discoveryQueue"`
+	SinkQueues     map[string]int             `json:"sinkQueues,omitempty"`
+	Devices        map[string]debugDevice     `json:"devices"`
+	Overdue        map[string]bool            `json:"overdue,omitempty"`
+	Sightings      map[string]debugSighting   `json:"sightings,omitempty"`
+	Forgotten      map[string]debugForgotten  `json:"forgotten,omitempty"`
+	AdvNames       map[string]string          `json:"advertisedNames,omitempty"`
+	Nearby         int                        `json:"nearby"`
+	Snapshots      [2]map[string]Reading      `json:"snapshots"`
+	FieldTimes     map[string]debugFieldTimes `json:"fieldTimes,omitempty"`
+}
+
+type debugDevice struct {
+	savedDevice
+	Config     *deviceConfig `json:"config,omitempty"`
+	LastTemp   time.Time     `json:"lastTemperature"`
+	Message    string        `json:"message"`
+	Changed    bool          `json:"changed"`
+	Summarized *Reading      `json:"summarized,omitempty"`
+	Published  string        `json:"published,omitempty"`
+	Status     deviceStatus  `json:"status"`
+	LightCfg   []string      `json:"lightInfo,omitempty"`
+	RSSIStats  struct {
+		Min   int `json:"min"`
+		Max   int `json:"max"`
+		Sum   int `json:"sum"`
+		Count int `json:"count"`
+	} `json:"rssiStats"`
+	History  int `json:"history"`
+	Flatline struct {
+		Value   float64   `json:"value"`
+		Changed time.Time `json:"changed"`
+		Updates int       `json:"updates"`
+		Flagged bool      `json:"flagged"`
+	} `json:"flatline"`
+	Collisions struct {
+		Jumps    int       `json:"jumps"`
+		Reported time.Time `json:"reported"`
+	} `json:"collisions"`
+	Aggregated int    `json:"aggregated"`
+	Raw        string `json:"raw,omitempty"`
+	Undecoded  string `json:"undecoded,omitempty"`
+}
+
+type debugSighting struct {
+	Count int       `json:"count"`
+	First time.Time `json:"first"`
+}
+
+type debugForgotten struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type debugFieldTimes struct {
+	Last     time.Time `json:"last"`
+	Interval float64   `json:"interval"`
+}
+
+// handleDebugState returns the debugState, with -debug.
+func (s *state) handleDebugState(w http.ResponseWriter, req *http.Request) {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+
+	s.mut.Lock()
+	ds := debugState{
+		Started:        s.started,
+		LastAny:        s.lastAny,
+		Flags:          flags,
+		DiscoveryQueue: len(s.disco),
+		Devices:        make(map[string]debugDevice, len(s.updates)),
+		Overdue:        s.overdue,
+		Sightings:      make(map[string]debugSighting, len(s.sightings)),
+		Forgotten:      make(map[string]debugForgotten, len(s.forgotten)),
+		AdvNames:       s.advNames,
+		Nearby:         len(s.nearby),
+		FieldTimes:     make(map[string]debugFieldTimes, len(s.fieldTimes)),
+	}
+	if ns := atomic.LoadInt64(&s.lastScrape); ns != 0 {
+		ds.LastScrape = monoTime(ns)
+	}
+	if len(s.sinks) > 0 {
+		ds.SinkQueues = make(map[string]int, len(s.sinks))
+		for _, q := range s.sinks {
+			ds.SinkQueues[q.name] = len(q.queue)
+		}
+	}
+	saved := s.snapshot()
+	for id, cur := range s.updates {
+		dev := debugDevice{
+			savedDevice: saved.Devices[id],
+			LastTemp:    cur.lastTemp,
+			Message:     cur.message,
+			Changed:     cur.changed,
+			Summarized:  cur.summarized,
+			Published:   cur.published,
+			Status:      cur.status,
+			LightCfg:    cur.lightCfg,
+			History:     len(cur.history.samples),
+			Aggregated:  cur.aggregate.n,
+			Raw:         hex.EncodeToString(cur.raw),
+			Undecoded:   hex.EncodeToString(cur.undecoded),
+		}
+		if cfg, ok := s.cfg.devices[id]; ok {
+			dev.Config = &cfg
+		}
+		dev.RSSIStats.Min, dev.RSSIStats.Max = cur.rssiStats.min, cur.rssiStats.max
+		dev.RSSIStats.Sum, dev.RSSIStats.Count = cur.rssiStats.sum, cur.rssiStats.count
+		dev.Flatline.Value, dev.Flatline.Changed = cur.flatline.value, cur.flatline.changed
+		dev.Flatline.Updates, dev.Flatline.Flagged = cur.flatline.updates, cur.flatline.flagged
+		dev.Collisions.Jumps, dev.Collisions.Reported = len(cur.collisions.jumps), cur.collisions.reported
+		ds.Devices[id] = dev
+	}
+	for id, sg := range s.sightings {
+		ds.Sightings[id] = debugSighting{Count: sg.count, First: sg.first}
+	}
+	for id, f := range s.forgotten {
+		ds.Forgotten[id] = debugForgotten{FirstSeen: f.firstSeen, LastSeen: f.lastSeen}
+	}
+	for k, ft := range s.fieldTimes {
+		ds.FieldTimes[k.device+" "+k.field] = debugFieldTimes{Last: ft.last, Interval: ft.interval.Seconds()}
+	}
+	for i, snap := range s.snapshots {
+		ds.Snapshots[i] = snap.readings
+	}
+	// Encode while holding the lock, as some of the maps are shared.
+	bs, err := json.MarshalIndent(ds, "", "  ")
+	s.mut.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bs)
+}
+
+// redactFlag returns the flag value, or a placeholder for flags holding
+// secrets. URLs keep only their scheme and host, as webhook URLs carry
+// their secret in the path or query and others may have credentials.
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, secret := range []string{"password", "token", "secret", "key", "connection-string", "community", "auth"} {
+		if strings.Contains(name, secret) {
+			return "(redacted)"
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.User != nil {
+			u.User = url.User("(redacted)")
+		}
+		if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+			return u.Scheme + "://" + u.Host + "/(redacted)"
+		}
+		return u.String()
+	}
+	return value
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// readingSnapshot is the latest reading of every device at a point in
+// time. The last two are kept, taken at each periodic summary, for
+// /debug/diff.
+type readingSnapshot struct {
+	when     time.Time
+	readings map[string]Reading
+}
+
+func (s *state) takeSnapshot(now time.Time) {
+	snap := readingSnapshot{when: now, readings: make(map[string]Reading, len(s.updates))}
+	for id, cur := range s.updates {
+		snap.readings[id] = cur.reading
+	}
+	s.snapshots[0], s.snapshots[1] = s.snapshots[1], snap
+}
+
+type snapshotDiff struct {
+	From    time.Time             `json:"from"`
+	To      time.Time             `json:"to"`
+	Added   []string              `json:"added,omitempty"`
+	Removed []string              `json:"removed,omitempty"`
+	Changed map[string]deviceDiff `json:"changed"`
+}
+
+// deviceDiff holds the values that changed for a device; unchanged values
+// are nil.
+type deviceDiff struct {
+	Temperature *valueDiff `json:"temperature,omitempty"`
+	Humidity    *valueDiff `json:"humidity,omitempty"`
+	Battery     *valueDiff `json:"battery,omitempty"`
+}
+
+type valueDiff struct {
+	From  *float64 `json:"from"`
+	To    *float64 `json:"to"`
+	Delta *float64 `json:"delta,omitempty"` // when both are set
+}
+
+// diffValues returns the change between two optional values, or nil if
+// there is none.
+func diffValues(from, to *float64) *valueDiff {
+	switch {
+	case from == nil && to == nil:
+		return nil
+	case from != nil && to != nil:
+		if *from == *to {
+			return nil
+		}
+		d := *to - *from
+		return &valueDiff{From: from, To: to, Delta: &d}
+	default:
+		return &valueDiff{From: from, To: to}
+	}
+}
+
+func diffSnapshots(a, b readingSnapshot) snapshotDiff {
+	diff := snapshotDiff{From: a.when, To: b.when, Changed: make(map[string]deviceDiff)}
+	for id, rb := range b.readings {
+		ra, ok := a.readings[id]
+		if !ok {
+			diff.Added = append(diff.Added, id)
+			continue
+		}
+		battA, battB := float64(ra.Battery), float64(rb.Battery)
+		d := deviceDiff{
+			Temperature: diffValues(ra.Temperature, rb.Temperature),
+			Humidity:    diffValues(ra.Humidity, rb.Humidity),
+			Battery:     diffValues(&battA, &battB),
+		}
+		if d != (deviceDiff{}) {
+			diff.Changed[id] = d
+		}
+	}
+	for id := range a.readings {
+		if _, ok := b.readings[id]; !ok {
+			diff.Removed = append(diff.Removed, id)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// handleDiff returns what changed between the last two snapshots.
+func (s *state) handleDiff(w http.ResponseWriter, req *http.Request) {
+	s.mut.Lock()
+	a, b := s.snapshots[0], s.snapshots[1]
+	var diff snapshotDiff
+	if a.readings != nil {
+		diff = diffSnapshots(a, b)
+	}
+	s.mut.Unlock()
+	if a.readings == nil {
+		http.Error(w, "Not enough snapshots yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(diff)
+}
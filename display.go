@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// displayFormat is how temperatures and humidity are shown in the human
+// facing outputs: log messages, the TUI and the summaries. Metrics and
+// the JSON outputs always carry full precision in °C.
+type displayFormat struct {
+	precision  int // decimals
+	fahrenheit bool
+	ascii      bool // no degree sign
+}
+
+// display is set from -display-precision, -display-unit and -ascii-logs.
+var display = displayFormat{precision: 1}
+
+func parseDisplayUnit(unit string) (bool, error) {
+	switch unit {
+	case "C", "c":
+		return false, nil
+	case "F", "f":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown unit %q", unit)
+	}
+}
+
+// temp formats a temperature given in °C.
+func (d displayFormat) temp(c float64) string {
+	if d.fahrenheit {
+		return d.number(c*9/5+32, false) + d.degree() + "F"
+	}
+	return d.number(c, false) + d.degree() + "C"
+}
+
+// tempDelta formats a temperature difference given in °C, with its sign.
+func (d displayFormat) tempDelta(c float64) string {
+	if d.fahrenheit {
+		return d.number(c*9/5, true) + d.degree() + "F"
+	}
+	return d.number(c, true) + d.degree() + "C"
+}
+
+// degree returns the degree sign, or nothing with ascii set.
+func (d displayFormat) degree() string {
+	if d.ascii {
+		return ""
+	}
+	return "°"
+}
+
+// rh formats a relative humidity.
+func (d displayFormat) rh(v float64) string {
+	return d.number(v, false) + "%"
+}
+
+// rhDelta formats a relative humidity difference, with its sign.
+func (d displayFormat) rhDelta(v float64) string {
+	return d.number(v, true) + "%"
+}
+
+func (d displayFormat) number(v float64, sign bool) string {
+	s := strconv.FormatFloat(v, 'f', d.precision, 64)
+	if sign && v >= 0 {
+		s = "+" + s
+	}
+	return s
+}
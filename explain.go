@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// explain writes an annotated breakdown of the manufacturer data to w: the
+// prefix, battery and format bytes, then each field with its header flags,
+// the bytes it took and the decoded value. It follows the same steps as
+// parse, and must be kept in step with it, but carries on describing what
+// it can where parse would give up on the advertisement.
+func explain(w io.Writer, id string, data []byte) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d bytes: %x\n", id, len(data), data)
+	defer func() { io.WriteString(w, b.String()) }()
+
+	if !isSensorBug(data) {
+		if len(data) < 7 {
+			fmt.Fprintf(&b, "  too short for a SensorBug header\n")
+			return
+		}
+		fmt.Fprintf(&b, "  prefix %x: not a SensorBug (want %x)\n", data[:5], sensorBugPrefix)
+		return
+	}
+	fmt.Fprintf(&b, "  [0:5] prefix %x: SensorBug\n", data[:5])
+	fmt.Fprintf(&b, "  [5] battery 0x%02x: %d%%\n", data[5], data[5])
+	if data[6] != 0 {
+		fmt.Fprintf(&b, "  [6] format 0x%02x: unknown, decoding as 0x00\n", data[6])
+	} else {
+		fmt.Fprintf(&b, "  [6] format 0x00\n")
+	}
+
+	off := 7
+	for off < len(data) {
+		start := off
+		hdr := data[off]
+		dataType := hdr & 0b00_111111
+		hasData := hdr&0b01_000000 != 0
+		hasAlert := hdr&0b10_000000 != 0
+		off++
+		fmt.Fprintf(&b, "  [%d] field 0x%02x: type 0x%02x %s, data:%v alert:%v\n", start, hdr, dataType, fieldTypeName(dataType), hasData, hasAlert)
+
+		if hasAlert {
+			if off >= len(data) {
+				fmt.Fprintf(&b, "    alert: truncated\n")
+				return
+			}
+			fmt.Fprintf(&b, "    alert 0x%02x\n", data[off])
+			off++
+		}
+		if !hasData {
+			continue
+		}
+
+		rest := data[off:]
+		n, value, stop := explainValue(dataType, rest)
+		if n > len(rest) {
+			fmt.Fprintf(&b, "    value: truncated, want %d bytes, have %x\n", n, rest)
+			return
+		}
+		if n > 0 {
+			fmt.Fprintf(&b, "    value [%d:%d] %x: %s\n", off, off+n, rest[:n], value)
+		} else {
+			fmt.Fprintf(&b, "    %s\n", value)
+		}
+		off += n
+		if stop {
+			if off < len(data) {
+				fmt.Fprintf(&b, "  [%d] remainder %x: not decoded\n", off, data[off:])
+			}
+			return
+		}
+	}
+}
+
+// fieldTypeName returns the name of a field type, as used in Fields.
+func fieldTypeName(dataType byte) string {
+	switch dataType {
+	case humidityType:
+		return "humidity"
+	case 0x01:
+		return "accel"
+	case 0x02:
+		return "light"
+	case 0x03:
+		return "temp"
+	case 0x2f:
+		return "pairing"
+	case 0x3f:
+		return "encryption pairing"
+	default:
+		return "unknown"
+	}
+}
+
+// explainValue returns the number of bytes the value of a field of the
+// given type takes, a description of the decoded value, and whether parsing
+// stops after it. The length may exceed len(rest) for a truncated field.
+func explainValue(dataType byte, rest []byte) (int, string, bool) {
+	if dataType == humidityType {
+		if len(rest) < 2 {
+			return 2, "", false
+		}
+		return 2, fmt.Sprintf("%.02f%% RH", float64(binary.LittleEndian.Uint16(rest))/100), false
+	}
+
+	switch dataType {
+	case 0x01:
+		if len(rest) < 2 {
+			return 2, "", false
+		}
+		return 2, fmt.Sprintf("raw %d", binary.LittleEndian.Uint16(rest)), false
+
+	case 0x02:
+		if len(rest) < 1 {
+			return 1, "", false
+		}
+		cfg := rest[0]
+		dataLen := int(cfg & 0b0_0_00_00_11)
+		desc := fmt.Sprintf("ir:%v resolution:%d range:%d length:%d",
+			cfg&0b1_0_00_00_00 != 0, cfg&0b0_0_11_00_00>>4, cfg&0b0_0_00_11_00>>2, dataLen)
+		switch {
+		case dataLen == 3:
+			return 1, desc + ", unsupported length, parse fails here", true
+		case len(rest) < 1+dataLen:
+			return 1 + dataLen, "", false
+		case dataLen == 0:
+			return 1, desc + ", no value", false
+		}
+		l := Light{
+			IR:         cfg&0b1_0_00_00_00 != 0,
+			Resolution: int(cfg & 0b0_0_11_00_00 >> 4),
+			Range:      int(cfg & 0b0_0_00_11_00 >> 2),
+		}
+		if dataLen == 2 {
+			l.Value = binary.LittleEndian.Uint16(rest[1:])
+		} else {
+			l.Value = uint16(rest[1])
+		}
+		desc += fmt.Sprintf(", value %d", l.Value)
+		if lux, ok := l.Lux(); ok {
+			desc += fmt.Sprintf(" (%.01f lx)", lux)
+		}
+		return 1 + dataLen, desc, false
+
+	case 0x03:
+		if len(rest) < 2 {
+			return 2, "", false
+		}
+		raw := int16(binary.LittleEndian.Uint16(rest))
+		return 2, fmt.Sprintf("raw %d, %.04f%sC", raw, temperatureScale*float64(raw), display.degree()), false
+
+	case 0x2f:
+		return 1, "ignored", false
+
+	case 0x3f:
+		return 0, "parsing stops here", true
+
+	default:
+		if len(rest) < unknownFieldLen {
+			return unknownFieldLen, "", false
+		}
+		return unknownFieldLen, fmt.Sprintf("assumed %d byte value, raw %d", unknownFieldLen, binary.LittleEndian.Uint16(rest)), false
+	}
+}
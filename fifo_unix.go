@@ -0,0 +1,101 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fifoSink writes samples as newline delimited JSON, or as protobuf each
+// preceded by its length as a varint, to a named pipe. The pipe is opened
+// non-blocking, so samples are dropped while no reader is
+// attached or the reader falls behind, and it is reopened when a reader
+// comes back. Each sample is well under PIPE_BUF and so written
+// atomically: a reader never sees a partial one.
+type fifoSink struct {
+	path     string
+	encoding sampleEncoding
+
+	mut sync.Mutex // protects fd
+	fd  *os.File
+}
+
+func newFIFOSink(path string, encoding sampleEncoding) (*fifoSink, error) {
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeNamedPipe == 0:
+		return nil, fmt.Errorf("%s: not a named pipe", path)
+	}
+	return &fifoSink{path: path, encoding: encoding}, nil
+}
+
+func (f *fifoSink) Publish(sample Sample) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.fd == nil {
+		fd, err := os.OpenFile(f.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if errors.Is(err, syscall.ENXIO) {
+			// No reader
+			sinkDropped.WithLabelValues("fifo").Inc()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f.fd = fd
+	}
+
+	bs, err := f.encoding.marshal(sample)
+	if err != nil {
+		return err
+	}
+	if f.encoding == encodingProtobuf {
+		bs = protowire.AppendBytes(nil, bs)
+	} else {
+		bs = append(bs, '\n')
+	}
+	_, err = f.fd.Write(bs)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EAGAIN):
+		// The reader is not keeping up
+		sinkDropped.WithLabelValues("fifo").Inc()
+		return nil
+	case errors.Is(err, syscall.EPIPE):
+		// The reader went away; reopen on the next sample
+		f.fd.Close()
+		f.fd = nil
+		sinkDropped.WithLabelValues("fifo").Inc()
+		return nil
+	default:
+		f.fd.Close()
+		f.fd = nil
+		return err
+	}
+}
+
+// Flush closes the pipe. Samples are written as they are published, so
+// there is nothing buffered.
+func (f *fifoSink) Flush(context.Context) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.fd != nil {
+		return f.fd.Close()
+	}
+	return nil
+}
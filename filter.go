@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/photostorm/gatt"
+)
+
+// A serviceFilter matches advertisements on the service UUIDs they
+// advertise, either in the service list or as service data. It narrows
+// down the advertisements that match the SensorBug prefix; there is no
+// decoder for anything else, so it can't widen them.
+type serviceFilter struct {
+	uuids []gatt.UUID
+}
+
+// parseServiceFilter parses a comma separated list of UUIDs.
+func parseServiceFilter(list string) (serviceFilter, error) {
+	var f serviceFilter
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := gatt.ParseUUID(s)
+		if err != nil {
+			return f, fmt.Errorf("service UUID %q: %w", s, err)
+		}
+		f.uuids = append(f.uuids, u)
+	}
+	return f, nil
+}
+
+// matches returns true if the advertisement passes the filter. An empty
+// filter passes everything.
+func (f serviceFilter) matches(a *gatt.Advertisement) bool {
+	return len(f.uuids) == 0 || f.advertised(a)
+}
+
+func (f serviceFilter) advertised(a *gatt.Advertisement) bool {
+	for _, u := range f.uuids {
+		// Not gatt.UUIDContains, which matches anything in a nil list
+		for _, s := range a.Services {
+			if s.Equal(u) {
+				return true
+			}
+		}
+		for _, sd := range a.ServiceData {
+			if sd.UUID.Equal(u) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wantDevice reports whether discoveries from the device with the given
+// real ID are processed. Devices in the config file always are; other
+// devices must match -device-regex, or with -device-regex-invert must not
+// match it, when it is set.
+func (s *state) wantDevice(rawID string) bool {
+	if s.cfg.idRegex == nil {
+		return true
+	}
+	if s.cfg.configuredIDs[rawID] {
+		return true
+	}
+	return s.cfg.idRegex.MatchString(rawID) != s.cfg.idRegexInvert
+}
+
+// A fieldFilter is a set of field names, as in Reading.Fields, to leave
+// out of metrics, logs and sinks.
+type fieldFilter map[string]bool
+
+// parseFieldFilter parses a comma separated list of field names. The
+// battery field is always present and can't be disabled.
+func parseFieldFilter(list string) (fieldFilter, error) {
+	f := make(fieldFilter)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch {
+		case s == "":
+			continue
+		case s == "accel", s == "light", s == "temp", s == "humidity":
+		case len(s) == 4 && strings.HasPrefix(s, "0x"):
+			var t byte
+			if _, err := fmt.Sscanf(s, "0x%02x", &t); err != nil {
+				return nil, fmt.Errorf("field %q: not a field type code", s)
+			}
+		default:
+			return nil, fmt.Errorf("field %q: unknown or can't be disabled", s)
+		}
+		f[s] = true
+	}
+	return f, nil
+}
+
+// apply returns the reading without the filtered fields. The parser has
+// already consumed their bytes, so this only affects what is exported.
+func (f fieldFilter) apply(r Reading) Reading {
+	if len(f) == 0 {
+		return r
+	}
+	fields := make([]string, 0, len(r.Fields))
+	for _, name := range r.Fields {
+		if !f[name] {
+			fields = append(fields, name)
+		}
+	}
+	r.Fields = fields
+	if f["accel"] {
+		r.Accel = nil
+	}
+	if f["light"] {
+		r.Light = nil
+	}
+	if f["temp"] {
+		r.Temperature = nil
+		r.RawTemperature = nil
+		r.Probes = nil
+	}
+	if f["humidity"] {
+		r.Humidity = nil
+	}
+	var alerts map[string]byte
+	for name, v := range r.Alerts {
+		if !f[name] {
+			if alerts == nil {
+				alerts = make(map[string]byte)
+			}
+			alerts[name] = v
+		}
+	}
+	r.Alerts = alerts
+	var unknown []RawField
+	for _, u := range r.Unknown {
+		if !f[fmt.Sprintf("0x%02x", u.Type)] {
+			unknown = append(unknown, u)
+		}
+	}
+	r.Unknown = unknown
+	return r
+}
+
+// A sinkFilter, from the sinks section of the config file, limits what is
+// published to one sink.
+type sinkFilter struct {
+	// Devices, if set, are the only devices published to the sink.
+	Devices []string `yaml:"devices"`
+	// Fields, if set, are the only fields published to the sink, by name
+	// as in Reading.Fields. Samples carrying none of them are not
+	// published to it at all. The battery level is part of the header
+	// and always published.
+	Fields []string `yaml:"fields"`
+}
+
+// sampleFilter is the parsed form of a sinkFilter. The zero value passes
+// everything.
+type sampleFilter struct {
+	devices map[string]bool
+	fields  fieldFilter
+}
+
+// parse returns the sampleFilter, with the device IDs anonymized as the
+// samples will be.
+func (f sinkFilter) parse(anon *anonymizer) (sampleFilter, error) {
+	var sf sampleFilter
+	if len(f.Devices) > 0 {
+		sf.devices = make(map[string]bool, len(f.Devices))
+		for _, id := range f.Devices {
+			sf.devices[anon.id(id)] = true
+		}
+	}
+	fields, err := parseFieldFilter(strings.Join(f.Fields, ","))
+	if err != nil {
+		return sf, err
+	}
+	if len(fields) > 0 {
+		sf.fields = fields
+	}
+	return sf, nil
+}
+
+// apply returns the sample with only the wanted fields, and whether it
+// should be published at all.
+func (f sampleFilter) apply(sample Sample) (Sample, bool) {
+	if f.devices != nil && !f.devices[sample.Device] {
+		return sample, false
+	}
+	if f.fields == nil {
+		return sample, true
+	}
+	wanted := false
+	drop := make(fieldFilter)
+	for _, name := range sample.Fields {
+		switch {
+		case name == "battery":
+		case f.fields[name]:
+			wanted = true
+		default:
+			drop[name] = true
+		}
+	}
+	if !wanted {
+		return sample, false
+	}
+	for name := range sample.Alerts {
+		if !f.fields[name] {
+			drop[name] = true
+		}
+	}
+	sample.Reading = drop.apply(sample.Reading)
+	return sample, true
+}
@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// flatline tracks how long a device's temperature has stayed exactly the
+// same. A real sensor jitters by at least a step now and then, so a value
+// that doesn't move at all over a long period and many updates suggests a
+// stuck sensor, or a field that stopped updating while advertising goes
+// on.
+type flatline struct {
+	value   float64
+	changed time.Time // when the value last changed
+	updates int       // updates since then, the change included
+	flagged bool
+}
+
+// observe records a temperature and returns whether it started a flatline
+// (the value hasn't changed over at least window and minUpdates updates)
+// or ended one.
+func (f *flatline) observe(now time.Time, temp float64, window time.Duration, minUpdates int) (started, ended bool) {
+	if f.updates == 0 || temp != f.value {
+		ended = f.flagged
+		*f = flatline{value: temp, changed: now, updates: 1}
+		return false, ended
+	}
+	f.updates++
+	if !f.flagged && f.updates >= minUpdates && now.Sub(f.changed) >= window {
+		f.flagged = true
+		return true, false
+	}
+	return false, false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// labelGatherer adds a fixed set of labels to every metric gathered from
+// the underlying gatherer.
+type labelGatherer struct {
+	prometheus.Gatherer
+	labels prometheus.Labels
+}
+
+func (g labelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for name, value := range g.labels {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+			}
+			sort.Slice(m.Label, func(a, b int) bool { return m.Label[a].GetName() < m.Label[b].GetName() })
+		}
+	}
+	return mfs, err
+}
+
+// lockedGatherer holds a lock while gathering. The per-device gauges are
+// all updated under the state lock, so gathering under it too means a
+// scrape never sees a device's metrics half updated from an advertisement.
+type lockedGatherer struct {
+	prometheus.Gatherer
+	mut *sync.Mutex
+}
+
+func (g lockedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.Gatherer.Gather()
+}
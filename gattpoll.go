@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/photostorm/gatt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// minPollInterval protects device batteries from a too eager config.
+	minPollInterval = time.Minute
+	// pollTimeout is how long a connection attempt may take before we
+	// give up on it and allow other devices to be polled.
+	pollTimeout = time.Minute
+)
+
+var gattValue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "btl",
+	Subsystem: "gatt",
+	Name:      "value",
+	Help:      "Value of a polled GATT characteristic, read as a little endian unsigned integer.",
+}, []string{"unit", "characteristic"})
+
+var adapterErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "btl",
+	Subsystem: "adapter",
+	Name:      "errors_total",
+	Help:      "Recoverable errors reported by the Bluetooth stack, by operation.",
+}, []string{"op"})
+
+var gattConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "btl",
+	Subsystem: "gatt",
+	Name:      "connections_total",
+	Help:      "Connection attempts to polled devices, by result (success or failure).",
+}, []string{"result"})
+
+var gattConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "btl",
+	Subsystem: "gatt",
+	Name:      "connected",
+	Help:      "Number of polled devices currently connected.",
+})
+
+// pollConfig configures periodically connecting to a device to read GATT
+// characteristics.
+type pollConfig struct {
+	Interval        time.Duration `yaml:"interval"`
+	Characteristics []string      `yaml:"characteristics"`
+}
+
+type pollTarget struct {
+	interval time.Duration
+	chars    []gatt.UUID
+}
+
+// poller connects to configured devices, one at a time and no more often
+// than their poll interval, to read characteristics that are not part of
+// the advertisement.
+type poller struct {
+	targets map[string]pollTarget // by real device ID
+	anon    *anonymizer
+
+	mut       sync.Mutex
+	last      map[string]time.Time
+	busy      string // device currently being polled, if any
+	busySince time.Time
+	connected map[string]bool
+}
+
+func newPoller(devices map[string]deviceConfig, anon *anonymizer) (*poller, error) {
+	p := &poller{
+		targets:   make(map[string]pollTarget),
+		anon:      anon,
+		last:      make(map[string]time.Time),
+		connected: make(map[string]bool),
+	}
+	for id, dev := range devices {
+		if dev.Poll == nil {
+			continue
+		}
+		t, err := parsePollConfig(*dev.Poll)
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", id, err)
+		}
+		p.targets[id] = t
+	}
+	return p, nil
+}
+
+func parsePollConfig(cfg pollConfig) (pollTarget, error) {
+	if cfg.Interval < minPollInterval {
+		return pollTarget{}, fmt.Errorf("poll interval must be at least %v", minPollInterval)
+	}
+	if len(cfg.Characteristics) == 0 {
+		return pollTarget{}, fmt.Errorf("no characteristics to poll")
+	}
+	t := pollTarget{interval: cfg.Interval}
+	for _, s := range cfg.Characteristics {
+		u, err := gatt.ParseUUID(s)
+		if err != nil {
+			return pollTarget{}, fmt.Errorf("characteristic %q: %w", s, err)
+		}
+		t.chars = append(t.chars, u)
+	}
+	return t, nil
+}
+
+// maybePoll starts a connection to the peripheral if it is due for
+// polling and no other poll is in progress.
+func (p *poller) maybePoll(per gatt.Peripheral, now time.Time) {
+	t, ok := p.targets[per.ID()]
+	if !ok {
+		return
+	}
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.busy != "" && now.Sub(p.busySince) < pollTimeout {
+		return
+	}
+	if now.Sub(p.last[per.ID()]) < t.interval {
+		return
+	}
+	p.busy = per.ID()
+	p.busySince = now
+	p.last[per.ID()] = now
+	per.Device().Connect(per)
+}
+
+func (p *poller) onConnected(per gatt.Peripheral, err error) {
+	t, ok := p.targets[per.ID()]
+	if !ok {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: connect: %v\n", p.anon.id(per.ID()), err)
+		adapterErrors.WithLabelValues("connect").Inc()
+		gattConnections.WithLabelValues("failure").Inc()
+		p.done(per.ID())
+		return
+	}
+	gattConnections.WithLabelValues("success").Inc()
+	p.setConnected(per.ID(), true)
+	defer per.Device().CancelConnection(per)
+
+	svcs, err := per.DiscoverServices(nil)
+	if err != nil {
+		log.Printf("%s: discover services: %v\n", p.anon.id(per.ID()), err)
+		adapterErrors.WithLabelValues("discover").Inc()
+		return
+	}
+	for _, svc := range svcs {
+		chars, err := per.DiscoverCharacteristics(t.chars, svc)
+		if err != nil {
+			log.Printf("%s: discover characteristics: %v\n", p.anon.id(per.ID()), err)
+			adapterErrors.WithLabelValues("discover").Inc()
+			continue
+		}
+		for _, c := range chars {
+			if !gatt.UUIDContains(t.chars, c.UUID()) {
+				continue
+			}
+			val, err := per.ReadCharacteristic(c)
+			if err != nil {
+				log.Printf("%s: read %s: %v\n", p.anon.id(per.ID()), c.UUID(), err)
+				adapterErrors.WithLabelValues("read").Inc()
+				continue
+			}
+			if len(val) == 0 || len(val) > 8 {
+				log.Printf("%s: read %s: can't interpret %d byte value %x\n", p.anon.id(per.ID()), c.UUID(), len(val), val)
+				continue
+			}
+			gattValue.WithLabelValues(p.anon.id(per.ID()), c.UUID().String()).Set(float64(littleEndianUint(val)))
+		}
+	}
+}
+
+func (p *poller) onDisconnected(per gatt.Peripheral, err error) {
+	if err != nil {
+		log.Printf("%s: disconnect: %v\n", p.anon.id(per.ID()), err)
+		adapterErrors.WithLabelValues("disconnect").Inc()
+	}
+	p.setConnected(per.ID(), false)
+	p.done(per.ID())
+}
+
+// forget removes the exported characteristic values of the device with the
+// given, anonymized, ID.
+func (p *poller) forget(id string) {
+	for real, t := range p.targets {
+		if p.anon.id(real) != id {
+			continue
+		}
+		for _, u := range t.chars {
+			gattValue.DeleteLabelValues(id, u.String())
+		}
+	}
+}
+
+func (p *poller) setConnected(id string, connected bool) {
+	p.mut.Lock()
+	if connected {
+		p.connected[id] = true
+	} else {
+		delete(p.connected, id)
+	}
+	gattConnected.Set(float64(len(p.connected)))
+	p.mut.Unlock()
+}
+
+func (p *poller) done(id string) {
+	p.mut.Lock()
+	if p.busy == id {
+		p.busy = ""
+	}
+	p.mut.Unlock()
+}
+
+func littleEndianUint(bs []byte) uint64 {
+	var v uint64
+	for i, b := range bs {
+		v |= uint64(b) << (8 * i)
+	}
+	return v
+}
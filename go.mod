@@ -3,6 +3,11 @@ module github.com/calmh/bls
 go 1.15
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/golang/snappy v0.0.3
 	github.com/photostorm/gatt v0.0.0-20201128210245-1c941537125d
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
+	google.golang.org/protobuf v1.23.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,24 @@
+package main
+
+// sampleHistory is a ring buffer of a device's most recent samples.
+type sampleHistory struct {
+	samples []Sample
+	next    int
+}
+
+// add records a sample, keeping at most size samples.
+func (h *sampleHistory) add(sample Sample, size int) {
+	if len(h.samples) < size {
+		h.samples = append(h.samples, sample)
+		return
+	}
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+}
+
+// ordered returns a copy of the samples, oldest first.
+func (h *sampleHistory) ordered() []Sample {
+	res := make([]Sample, 0, len(h.samples))
+	res = append(res, h.samples[h.next:]...)
+	return append(res, h.samples[:h.next]...)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// listen returns a listener for the given address, which is either a TCP
+// host:port (IPv4 or IPv6) or "unix:" followed by a socket path.
+func listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// Remove a stale socket left behind by an unclean exit
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serveHTTP runs the server on the listener until it is closed. A serve
+// error is fatal unless resilient is set, in which case the listener is
+// reopened on addr and serving resumes, leaving scanning unaffected.
+func serveHTTP(srv *http.Server, l net.Listener, addr string, resilient bool) {
+	for {
+		err := srv.Serve(l)
+		if err == nil || err == http.ErrServerClosed {
+			return
+		}
+		if !resilient {
+			fatalln("HTTP serve:", err)
+		}
+		log.Println("HTTP serve:", err)
+		subsystemRestarts.WithLabelValues("http").Inc()
+		for {
+			time.Sleep(5 * time.Second)
+			if l, err = listen(addr); err == nil {
+				break
+			}
+			log.Println("HTTP listen:", err)
+		}
+		log.Println("HTTP server restarted on", l.Addr())
+	}
+}
+
+// handler returns the HTTP handler for all endpoints, serving metrics from
+// the given gatherer.
+func (s *state) handler(gatherer prometheus.Gatherer, openMetrics bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.basicAuth(s.recordScrape(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: openMetrics})))))
+	mux.HandleFunc("/dump", s.handleDump)
+	mux.HandleFunc("/devices", s.handleDevices)
+	mux.HandleFunc("/reset-stats", s.handleResetStats)
+	mux.HandleFunc("/history", s.handleHistory)
+	mux.HandleFunc("/alerts.yaml", s.handleAlertRules)
+	mux.HandleFunc("/debug/diff", s.handleDiff)
+	mux.Handle("/names/", s.basicAuth(http.HandlerFunc(s.handleName)))
+	if s.cfg.debug {
+		mux.Handle("/debug/state", s.basicAuth(http.HandlerFunc(s.handleDebugState)))
+	}
+	return mux
+}
+
+// basicAuth requires the configured HTTP basic authentication credentials,
+// if any.
+func (s *state) basicAuth(next http.Handler) http.Handler {
+	if s.cfg.httpAuth == "" {
+		return next
+	}
+	user, pass := splitAuth(s.cfg.httpAuth)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(pass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="btl"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func splitAuth(auth string) (user, pass string) {
+	i := strings.IndexByte(auth, ':')
+	return auth[:i], auth[i+1:]
+}
+
+// maxNameLen is the longest friendly name accepted by /names.
+const maxNameLen = 64
+
+// handleName sets the friendly name of the device given in the path,
+// /names/<id>, from a JSON body {"name": "..."}. An empty name removes it.
+// The change is saved to the config file, if there is one, and the
+// resulting names of all configured devices are returned.
+func (s *state) handleName(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/names/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, "Missing or invalid device ID", http.StatusBadRequest)
+		return
+	}
+	if s.cfg.anon != nil {
+		http.Error(w, "Names can't be changed while device IDs are anonymized", http.StatusConflict)
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if len(name) > maxNameLen || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.cfg.configPath != "" {
+		if err := saveDeviceName(s.cfg.configPath, id, name); err != nil {
+			log.Println("Saving name:", err)
+			http.Error(w, "Saving config failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	// The reading gauges may carry the name as a label; drop the series
+	// under the old one before the name changes, and export the last
+	// reading again below under the new one.
+	cur := s.updates[id]
+	if cur != nil {
+		old := s.cfg.labels.values(id, s.cfg.devices[id].Group, s.name(id))
+		for _, g := range readingGauges {
+			(*g.vec).DeleteLabelValues(old...)
+		}
+	}
+	// Replace rather than modify the map, as the previous one may
+	// have been handed out.
+	devices := make(map[string]deviceConfig, len(s.cfg.devices)+1)
+	for k, v := range s.cfg.devices {
+		devices[k] = v
+	}
+	dev := devices[id]
+	dev.Name = name
+	devices[id] = dev
+	s.cfg.devices = devices
+	if cur != nil {
+		s.setMetrics(id, cur.reading)
+	}
+	log.Printf("%s: name set to %q\n", id, name)
+
+	names := make(map[string]string, len(devices))
+	for k, v := range devices {
+		if v.Name != "" {
+			names[k] = v.Name
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(names)
+}
+
+// handleDump requests an immediate summary of all tracked devices to the
+// log.
+func (s *state) handleDump(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case s.dump <- struct{}{}:
+	default:
+		// A dump is already pending
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type deviceInfo struct {
+	LastSeen   time.Time `json:"lastSeen"`
+	Reading    Reading   `json:"reading"`
+	FieldsSeen []string  `json:"fieldsSeen"`
+	// Status is ok, warn or critical, for devices with configured
+	// temperature ranges.
+	Status *deviceStatus `json:"status,omitempty"`
+	// FieldIntervals is the time in seconds between the last two
+	// advertisements carrying each field type.
+	FieldIntervals map[string]float64 `json:"fieldIntervals,omitempty"`
+	Temperature    *tempRange         `json:"temperatureStats,omitempty"`
+	// Raw and Undecoded are the hex encoded manufacturer data and the part
+	// of it left undecoded, in debug mode.
+	Raw       string `json:"raw,omitempty"`
+	Undecoded string `json:"undecoded,omitempty"`
+}
+
+type tempRange struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Count int     `json:"count"`
+}
+
+// handleDevices returns the latest reading and statistics for all tracked
+// devices, keyed by device ID.
+func (s *state) handleDevices(w http.ResponseWriter, req *http.Request) {
+	s.mut.Lock()
+	devices := make(map[string]deviceInfo, len(s.updates))
+	for id, cur := range s.updates {
+		info := deviceInfo{
+			LastSeen: cur.lastSeen,
+			Reading:  cur.reading,
+		}
+		for f := range cur.fields {
+			info.FieldsSeen = append(info.FieldsSeen, f)
+			if ft := s.fieldTimes[fieldKey{id, f}]; ft != nil && ft.interval > 0 {
+				if info.FieldIntervals == nil {
+					info.FieldIntervals = make(map[string]float64)
+				}
+				info.FieldIntervals[f] = ft.interval.Seconds()
+			}
+		}
+		sort.Strings(info.FieldsSeen)
+		if s.cfg.devices[id].hasRanges() {
+			st := cur.status
+			info.Status = &st
+		}
+		if t := cur.temp; t.count > 0 {
+			info.Temperature = &tempRange{Min: t.min, Max: t.max, Avg: t.avg(), Count: t.count}
+		}
+		info.Raw = hex.EncodeToString(cur.raw)
+		info.Undecoded = hex.EncodeToString(cur.undecoded)
+		devices[id] = info
+	}
+	s.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(devices)
+}
+
+// handleHistory returns the recent samples from the device given by the
+// device query parameter, oldest first.
+func (s *state) handleHistory(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("device")
+	if id == "" {
+		http.Error(w, "Missing device parameter", http.StatusBadRequest)
+		return
+	}
+	s.mut.Lock()
+	cur, ok := s.updates[id]
+	var samples []Sample
+	if ok {
+		samples = cur.history.ordered()
+	}
+	s.mut.Unlock()
+	if !ok {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(samples)
+}
+
+// handleResetStats clears the running temperature statistics.
+func (s *state) handleResetStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mut.Lock()
+	s.resetStats()
+	s.mut.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordScrape wraps the metrics handler to keep track of when we were
+// last scraped.
+func (s *state) recordScrape(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		atomic.StoreInt64(&s.lastScrape, monoNanos(now))
+		lastScrape.Set(float64(now.UnixNano()) / 1e9)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// accessLog logs each request with its response status and duration.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t0 := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+		log.Printf("HTTP %s %s %s: %d, %d bytes, %v\n", req.RemoteAddr, req.Method, req.URL.RequestURI(), sw.status, sw.written, time.Since(t0).Truncate(time.Microsecond))
+	})
+}
+
+// statusWriter records the status code and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(bs []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(bs)
+	w.written += n
+	return n, err
+}
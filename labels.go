@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The reading gauges are created by newReadingGauges, as their label names
+// depend on the -labels flag.
+var airTemp, airTempF, airTempRaw, airTempDisplay, battery, batteryRatio, humidity, light, illuminance *prometheus.GaugeVec
+
+var readingGauges = []struct {
+	vec  **prometheus.GaugeVec
+	opts prometheus.GaugeOpts
+}{
+	{&airTemp, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "temperature_c",
+	}},
+	{&airTempF, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "temperature_f",
+		Help:      "Temperature in degrees Fahrenheit.",
+	}},
+	{&airTempRaw, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "temperature_raw_c",
+		Help:      "Temperature before the configured calibration offset.",
+	}},
+	{&airTempDisplay, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "temperature_display_c",
+		Help:      "Temperature rounded to the configured display precision.",
+	}},
+	{&battery, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "battery_percent",
+	}},
+	{&batteryRatio, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "battery_ratio",
+		Help:      "Battery level as a fraction, 0 to 1.",
+	}},
+	{&humidity, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "humidity_percent",
+	}},
+	{&light, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "light",
+		Help:      "Raw light sensor value, to be interpreted according to btl_sensorbug_light_info.",
+	}},
+	{&illuminance, prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "illuminance_lux",
+		Help:      "Light sensor value converted to lux, when not in IR mode.",
+	}},
+}
+
+// The gauges exist from the start, unregistered, so that they can be used
+// before main has parsed the flags and in tests.
+func init() {
+	newReadingGauges(labelSet{}.names())
+}
+
+// newReadingGauges (re)creates the reading gauges with the given label
+// names, without registering them.
+func newReadingGauges(names []string) {
+	for _, g := range readingGauges {
+		*g.vec = prometheus.NewGaugeVec(g.opts, names)
+	}
+}
+
+// registerReadingGauges creates the reading gauges with the given label
+// names and registers them. The registry remembers the label names of a
+// metric even once it is unregistered, so this can only be done once.
+func registerReadingGauges(names []string) {
+	newReadingGauges(names)
+	for _, g := range readingGauges {
+		prometheus.MustRegister(*g.vec)
+	}
+}
+
+// labelSet is the optional labels on the reading gauges. The unit label,
+// with the device ID, is always present.
+type labelSet struct {
+	group bool // the configured group
+	name  bool // the friendly name
+}
+
+func parseLabelSet(list string) (labelSet, error) {
+	var l labelSet
+	for _, s := range strings.Split(list, ",") {
+		switch strings.TrimSpace(s) {
+		case "", "unit":
+		case "group":
+			l.group = true
+		case "name":
+			l.name = true
+		default:
+			return l, fmt.Errorf("unknown label %q", s)
+		}
+	}
+	return l, nil
+}
+
+func (l labelSet) names() []string {
+	names := []string{"unit"}
+	if l.group {
+		names = append(names, "group")
+	}
+	if l.name {
+		names = append(names, "name")
+	}
+	return names
+}
+
+// values returns the label values for a device, matching names.
+func (l labelSet) values(id, group, name string) []string {
+	values := []string{id}
+	if l.group {
+		values = append(values, group)
+	}
+	if l.name {
+		values = append(values, name)
+	}
+	return values
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+)
+
+// defaultLogTemplate produces the same message as Reading.String.
+const defaultLogTemplate = `batt:{{.Battery}}%` +
+	`{{with .Light}} light:{{.IR}}/{{.Resolution}}/{{.Range}}/{{.Value}}{{end}}` +
+	`{{with .Temperature}} temp:{{temp (deref .)}}{{end}}` +
+	`{{with .RawTemperature}} raw:{{temp (deref .)}}{{end}}` +
+	`{{range .Probes}} probe:{{temp .}}{{end}}` +
+	`{{with .Humidity}} rh:{{rh (deref .)}}{{end}}`
+
+// logData is what the per-device log template is executed against.
+type logData struct {
+	Device string
+	Name   string
+	Reading
+}
+
+// logTemplateFuncs are available in log templates. The temp and rh
+// functions format values according to -display-precision and
+// -display-unit.
+var logTemplateFuncs = template.FuncMap{
+	"deref": func(v *float64) float64 { return *v },
+	"temp":  func(v float64) string { return display.temp(v) },
+	"rh":    func(v float64) string { return display.rh(v) },
+}
+
+// parseLogTemplate parses the template and verifies that it can be
+// executed against a fully populated reading.
+func parseLogTemplate(text string) (*template.Template, error) {
+	tpl, err := template.New("log").Funcs(logTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	temp, rh := 21.5, 45.0
+	test := logData{
+		Device: "00:00:00:00:00:00",
+		Name:   "test",
+		Reading: Reading{
+			Fields:      []string{"battery", "light", "temp", "humidity"},
+			Battery:     100,
+			Temperature: &temp,
+			Humidity:    &rh,
+			Light:       &Light{Value: 1},
+		},
+	}
+	if err := tpl.Execute(new(strings.Builder), test); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// formatMessage returns the log message for a reading.
+func (s *state) formatMessage(id string, r Reading) string {
+	return formatReading(s.cfg.logTemplate, id, s.name(id), r)
+}
+
+// formatReading returns the log message for a reading using the template,
+// or Reading.String if it is nil.
+func formatReading(tpl *template.Template, id, name string, r Reading) string {
+	if tpl == nil {
+		return r.String()
+	}
+	var str strings.Builder
+	data := logData{Device: id, Name: name, Reading: r}
+	if err := tpl.Execute(&str, data); err != nil {
+		return "template error: " + err.Error()
+	}
+	return str.String()
+}
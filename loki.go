@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// lokiMaxPending is the number of log lines buffered between pushes.
+// Lines beyond this are dropped until the next push.
+const lokiMaxPending = 10000
+
+// lokiSink pushes the per-device log message for each sample to a Loki
+// endpoint, batched on an interval. Each device is its own stream,
+// labelled with the device ID, its configured name as location and the
+// gateway when set.
+type lokiSink struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	template *template.Template // log message template, nil for the default
+
+	mut     sync.Mutex
+	pending map[string]*lokiStream // by device
+	count   int
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func newLokiSink(url string, interval time.Duration, tpl *template.Template) *lokiSink {
+	k := &lokiSink{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		template: tpl,
+		pending:  make(map[string]*lokiStream),
+	}
+	go k.run()
+	return k
+}
+
+// Publish buffers the log line for the next push.
+func (k *lokiSink) Publish(sample Sample) error {
+	line := formatReading(k.template, sample.Device, sample.Name, sample.Reading)
+
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if k.count >= lokiMaxPending {
+		sinkDropped.WithLabelValues("loki").Inc()
+		return nil
+	}
+	st := k.pending[sample.Device]
+	if st == nil {
+		st = &lokiStream{Stream: map[string]string{"device": sample.Device}}
+		if sample.Name != "" {
+			st.Stream["location"] = sample.Name
+		}
+		if sample.Gateway != "" {
+			st.Stream["gateway"] = sample.Gateway
+		}
+		k.pending[sample.Device] = st
+	}
+	st.Values = append(st.Values, [2]string{strconv.FormatInt(sample.Time.UnixNano(), 10), line})
+	k.count++
+	return nil
+}
+
+// Flush pushes the buffered lines.
+func (k *lokiSink) Flush(ctx context.Context) error {
+	return k.push(ctx)
+}
+
+func (k *lokiSink) run() {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := k.push(context.Background()); err != nil {
+			log.Println("Loki:", err)
+		}
+	}
+}
+
+// push sends and clears the buffered lines. Lines from a failed push are
+// dropped rather than retried, to keep the buffer bounded.
+func (k *lokiSink) push(ctx context.Context) error {
+	k.mut.Lock()
+	pending := k.pending
+	k.pending = make(map[string]*lokiStream)
+	k.count = 0
+	k.mut.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var body struct {
+		Streams []*lokiStream `json:"streams"`
+	}
+	for _, st := range pending {
+		body.Streams = append(body.Streams, st)
+	}
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
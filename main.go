@@ -1,91 +1,1042 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/photostorm/gatt"
 	"github.com/photostorm/gatt/examples/option"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	airTemp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	tempStep = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "btl",
 		Subsystem: "sensorbug",
-		Name:      "temperature_c",
+		Name:      "temperature_step_c",
+		Help:      "Size of one step of the decoded temperature value; readings change in multiples of this.",
+	})
+	probeTemp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "probe_temperature_c",
+		Help:      "Temperature from additional temperature fields, such as an external probe, numbered from 1 in advertisement order.",
+	}, []string{"unit", "channel"})
+	scanningActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Name:      "scanning_active",
+	})
+	adapterStartup = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "adapter",
+		Name:      "startup_seconds",
+		Help:      "Time from init until the adapter first reported powered on.",
+	})
+	discoDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "disco",
+		Name:      "channel_depth",
+		Help:      "Number of discoveries waiting to be processed.",
+	})
+	discoCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "disco",
+		Name:      "channel_capacity",
+		Help:      "Size of the discovery channel buffer.",
+	})
+	airTempMin = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "temperature_min_c",
+		Help:      "Lowest temperature seen since startup or the last stats reset.",
 	}, []string{"unit"})
-	battery = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	airTempMax = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "btl",
 		Subsystem: "sensorbug",
-		Name:      "battery_percent",
+		Name:      "temperature_max_c",
+		Help:      "Highest temperature seen since startup or the last stats reset.",
+	}, []string{"unit"})
+	lightInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "light_info",
+		Help:      "Light sensor configuration: IR mode and the resolution and range settings.",
+	}, []string{"unit", "ir", "resolution", "range"})
+	fieldInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "field_info",
+		Help:      "Set to 1 for each field type a device has reported.",
+	}, []string{"unit", "field"})
+	fieldInterval = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "field_interval_seconds",
+		Help:      "Time between the last two advertisements carrying each field type.",
+	}, []string{"unit", "field"})
+	rawField = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "raw",
+		Help:      "Raw little endian value of field types without a decoder.",
+	}, []string{"unit", "type"})
+	comfort = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "comfort_score",
+		Help:      "Comfort from 0 to 100, based on temperature and humidity against the configured ideals.",
+	}, []string{"unit"})
+	readings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "readings_total",
+		Help:      "Number of readings received, with the time of the latest as an exemplar.",
+	}, []string{"unit"})
+	undecodedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "undecoded_bytes",
+		Help:      "Bytes of the last advertisement taken up by field types without a decoder.",
+	}, []string{"unit"})
+	unknownFormat = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "unknown_format_total",
+		Help:      "Advertisements with a nonzero format byte, by format.",
+	}, []string{"unit", "format"})
+	accelRaw = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "accel_raw",
+		Help:      "Raw value of the accelerometer field, which accompanies motion alerts.",
+	}, []string{"unit"})
+	batteryRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "battery_percent_per_day",
+		Help:      "Battery trend over the last week, negative when discharging.",
+	}, []string{"unit"})
+	txPower = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "tx_power_dbm",
+		Help:      "Advertised transmit power, or the configured default when not advertised.",
+	}, []string{"unit"})
+	lastScrape = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Name:      "last_scrape_timestamp_seconds",
+		Help:      "Time of the last request for /metrics.",
+	})
+	firstSeen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "first_seen_timestamp_seconds",
+		Help:      "Time the device was first discovered.",
+	}, []string{"unit"})
+	heartbeat = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Name:      "heartbeat_timestamp_seconds",
+		Help:      "Time the main loop last ran its periodic checks, regardless of device activity.",
+	})
+	warmupSuppressed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "btl",
+		Name:      "warmup_suppressed_total",
+		Help:      "Readings logged but not exported during the startup warmup period.",
+	})
+	subsystemRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Name:      "subsystem_restarts_total",
+		Help:      "Number of times the HTTP server or scanner was restarted after a failure in resilient mode.",
+	}, []string{"subsystem"})
+	scanRestartsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "btl",
+		Name:      "scan_restarts_total",
+		Help:      "Number of periodic scan restarts.",
+	})
+	idCollisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Name:      "possible_id_collision_total",
+		Help:      "Number of times a device's readings suggested several devices reporting its ID.",
+	}, []string{"unit"})
+	parseDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "btl",
+		Name:      "parse_duration_seconds",
+		Help:      "Time taken to parse each advertisement that passed the filters.",
+		Buckets:   prometheus.ExponentialBuckets(100e-9, 4, 8), // 100 ns to 1.6 ms
+	})
+	flatlines = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "flatline_total",
+		Help:      "Number of times a device's temperature stayed exactly the same over the -flatline-window.",
+	}, []string{"unit"})
+	flags = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "flag",
+		Help:      "Set to 1 while the device flags an alert on a field, as flag=\"<field>_alert\".",
+	}, []string{"unit", "flag"})
+	nearby = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "ble",
+		Name:      "devices_nearby",
+		Help:      "Distinct BLE devices of any kind seen within the -nearby-window.",
+	})
+	status = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "status",
+		Help:      "Status from the temperature against the configured ranges: 0 ok, 1 warn, 2 critical.",
+	}, []string{"unit"})
+	overdue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sensorbug",
+		Name:      "overdue",
+		Help:      "Set to 1 when a device has not been seen within its configured timeout.",
 	}, []string{"unit"})
 )
 
 func main() {
+	var cfg config
+	listenAddr := flag.String("listen", ":9298", "HTTP listen address, host:port or unix:/path/to/socket (empty to disable the HTTP server)")
+	configPath := flag.String("config", "", "Path to YAML configuration file")
+	checkConfigPath := flag.String("check-config", "", "Validate this YAML configuration file, together with the other flags, and exit")
+	webhookURL := flag.String("webhook-url", "", "URL to post alert events to")
+	webhookQueue := flag.Int("webhook-queue", 64, "Number of alert events to buffer for the webhook")
+	webhookRetries := flag.Int("webhook-retries", 3, "Number of times to retry a failed webhook post")
+	webhookFailures := flag.Int("webhook-failures", 5, "Consecutive webhook failures before the circuit opens")
+	webhookCooldown := flag.Duration("webhook-cooldown", time.Minute, "Time before an open webhook circuit is retried")
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote write endpoint to push metrics to")
+	remoteWriteInterval := flag.Duration("remote-write-interval", time.Minute, "Interval between remote write pushes")
+	textfileDir := flag.String("textfile", "", "Directory to periodically write btl.prom to, for the node_exporter textfile collector")
+	textfileInterval := flag.Duration("textfile-interval", time.Minute, "Interval between textfile writes")
+	fifoPath := flag.String("fifo", "", "Write samples, as newline delimited JSON by default, to this named pipe, created if missing")
+	fifoEncoding := flag.String("fifo-encoding", "json", "Encoding of the samples written to -fifo: json, or protobuf with each sample preceded by its length as a varint")
+	lokiURL := flag.String("loki-url", "", "Loki push endpoint (e.g. http://loki:3100/loki/api/v1/push) to send the per-device log messages to")
+	lokiInterval := flag.Duration("loki-interval", 10*time.Second, "Interval between Loki pushes")
+	openTSDBURL := flag.String("opentsdb-url", "", "OpenTSDB put endpoint (e.g. http://opentsdb:4242/api/put) to send the readings to")
+	openTSDBInterval := flag.Duration("opentsdb-interval", 10*time.Second, "Interval between OpenTSDB pushes")
+	flag.StringVar(&cfg.httpAuth, "http-auth", "", "Require HTTP basic authentication as user:password for /metrics and /names")
+	readingLabels := flag.String("labels", "unit", "Labels for the reading metrics: unit, plus optionally group and name (comma separated)")
+	gatewayLabel := flag.Bool("gateway-label", false, "Add a gateway label with the receiving host name to all metrics and sink payloads")
+	flag.StringVar(&cfg.gateway, "gateway-name", hostname(), "Gateway name to use for the gateway label")
+	flag.BoolVar(&cfg.exportUnknown, "export-unknown", false, "Export the raw values of unknown field types")
+	flag.DurationVar(&cfg.watchdog, "watchdog", 0, "Exit if no advertisements at all are received for this long while scanning (0 to disable)")
+	// Passive scanning would spare the sensors the scan requests, but on
+	// Linux gatt holds back every scannable advertisement (ADV_IND and
+	// ADV_SCAN_IND) until its scan response arrives, and with passive
+	// scanning none ever does. SensorBugs advertise connectably, so
+	// passive scanning would deliver nothing from them; it is refused
+	// rather than silently receiving no discoveries.
+	scanType := flag.String("scan-type", "active", "Scan type; only \"active\" (request scan responses) is supported, see the source for why passive scanning isn't")
+	allowDuplicates := flag.Bool("allow-duplicates", true, "Report every advertisement rather than letting the controller filter duplicates")
+	flag.StringVar(&cfg.stateFile, "state-file", "", "Periodically save device state to this file and restore it on startup")
+	flag.DurationVar(&cfg.stateInterval, "state-interval", time.Minute, "Interval between state file saves")
+	summaryMode := flag.String("summary-mode", "absolute", "Show current values (\"absolute\") or the change since the last summary (\"delta\") in the periodic summary")
+	flag.BoolVar(&cfg.summaryRSSI, "summary-rssi", false, "Include each device's RSSI min/mean/max since the last summary in the periodic summary")
+	flag.BoolVar(&cfg.exportTxPower, "export-tx-power", false, "Export the advertised transmit power of each device")
+	flag.IntVar(&cfg.txPower, "tx-power", 0, "Transmit power in dBm to assume for devices that don't advertise it")
+	flag.DurationVar(&cfg.scrapeWarn, "scrape-warn", 0, "Warn if /metrics has not been scraped for this long (0 to disable)")
+	logTemplate := flag.String("log-template", defaultLogTemplate, "Go template for the per-device log message")
+	flag.IntVar(&cfg.sinkQueue, "sink-queue", 256, "Number of samples to buffer per sink")
+	sinkWorkers := flag.Int("sink-workers", 0, "Number of sink publishing goroutines, spread over the sinks with at least one each (0 for one per sink)")
+	flag.IntVar(&cfg.minSamples, "min-samples", 1, "Number of samples a device must send before its metrics are created")
+	flag.DurationVar(&cfg.minSamplesWindow, "min-samples-window", time.Hour, "Time within which a device must send the -min-samples samples, or be forgotten")
+	rateLimit := flag.Float64("rate-limit", 2000, "Maximum advertisements per second processed in total, dropping the rest (0 for no limit)")
+	rateLimitDevice := flag.Float64("rate-limit-device", 50, "Maximum advertisements per second processed from any one device, dropping the rest (0 for no limit)")
+	mergeTTL := flag.Duration("merge-ttl", 0, "Fill in a missing local name and TX power from discoveries of the same device within this time, for platforms that report scan responses separately (0 to disable)")
+	flag.DurationVar(&cfg.warmup, "warmup", 0, "Log but don't export readings received within this time of startup")
+	cfg.comfort = defaultComfort
+	flag.Float64Var(&cfg.comfort.temp, "comfort-temp", cfg.comfort.temp, "Ideal temperature in °C for the comfort score")
+	flag.Float64Var(&cfg.comfort.tempTolerance, "comfort-temp-tolerance", cfg.comfort.tempTolerance, "Temperature difference in °C from the ideal that halves the comfort score")
+	flag.Float64Var(&cfg.comfort.rh, "comfort-rh", cfg.comfort.rh, "Ideal relative humidity in percent for the comfort score")
+	flag.Float64Var(&cfg.comfort.rhTolerance, "comfort-rh-tolerance", cfg.comfort.rhTolerance, "Relative humidity difference in percent from the ideal that halves the comfort score")
+	disableFields := flag.String("disable-fields", "", "Field types to leave out of metrics, logs and sinks (comma separated, e.g. \"light,accel\")")
+	flag.IntVar(&cfg.historySize, "history", 100, "Number of recent samples to keep per device for /history (0 to disable)")
+	anonymize := flag.Bool("anonymize", false, "Replace device IDs with a keyed hash in metrics, logs and sinks")
+	anonymizeKey := flag.String("anonymize-key", "", "Key for -anonymize, to keep the hashes stable across restarts (random if empty)")
+	anonymizeMap := flag.String("anonymize-map", "", "File to append hash to device ID mappings to when using -anonymize")
+	flag.StringVar(&cfg.explain, "explain", "off", "Print an annotated breakdown of advertisements to stderr: \"off\", \"matching\" (those that pass the prefix and service filters) or \"all\"")
+	flag.BoolVar(&cfg.debug, "debug", false, "Include the raw and undecoded advertisement data in /devices, and serve the internal state on /debug/state")
+	flag.DurationVar(&cfg.scanRestart, "scan-restart-interval", 0, "Periodically stop and restart scanning at this interval (0 to disable)")
+	shutdownGrace := flag.Duration("shutdown-grace", 5*time.Second, "Time allowed on shutdown for sinks to publish queued samples")
+	accessLogs := flag.Bool("access-log", false, "Log every HTTP request")
+	openMetrics := flag.Bool("openmetrics", false, "Serve the OpenMetrics format, including exemplars, to scrapers that ask for it")
+	failMode := flag.String("fail-mode", "strict", "On HTTP server or scanner failure, exit (\"strict\") or log and restart the failed part (\"resilient\")")
+	decode := flag.String("decode", "", "Decode the given manufacturer data hex string, print the result and exit")
+	humType := flag.Uint("humidity-type", uint(humidityType), "Field type code carrying relative humidity")
+	flag.Float64Var(&temperatureScale, "temperature-scale", temperatureScale, "Degrees Celsius per step of the raw temperature value")
+	flag.IntVar(&display.precision, "display-precision", display.precision, "Decimals shown for temperature and humidity in logs and the TUI")
+	displayUnit := flag.String("display-unit", "C", "Temperature unit shown in logs and the TUI, C or F")
+	flag.BoolVar(&display.ascii, "ascii-logs", false, "Leave out the degree sign, showing e.g. 21.4C, in logs and the TUI")
+	flag.Float64Var(&cfg.tempPrecision, "temp-precision", 0, "Also export temperatures rounded to this many °C, e.g. 0.1, for display (0 to disable)")
+	overdueOn := flag.String("overdue-on", "seen", "What resets a device's overdue timeout: any advertisement (\"seen\"), or only one carrying a temperature (\"temperature\"), so that a failed sensor on a device that still advertises goes overdue")
+	flag.DurationVar(&cfg.newGrace, "new-grace", 10*time.Minute, "A device dropped from tracking (e.g. on SIGUSR2) and seen again within this time since it was last seen isn't logged as new")
+	flag.DurationVar(&cfg.nearbyWindow, "nearby-window", 0, "Export the number of distinct BLE devices of any kind seen within this window as btl_ble_devices_nearby (0 to disable)")
+	flag.BoolVar(&cfg.publishOnChange, "publish-on-change", false, "Only publish readings to the sinks when they differ from the last one published for the device")
+	flag.DurationVar(&cfg.aggregateWindow, "aggregate-window", 0, "Export the mean of each device's readings once per window instead of every reading (0 to export every reading)")
+	flag.DurationVar(&cfg.flatlineWindow, "flatline-window", 0, "Warn when a device's temperature hasn't changed at all for this long (0 to disable)")
+	flag.IntVar(&cfg.flatlineUpdates, "flatline-updates", 10, "Minimum number of unchanged temperature updates for a -flatline-window warning")
+	flag.IntVar(&cfg.alertBattery, "alert-battery", 20, "Battery percentage below which the rules from /alerts.yaml alert")
+	flag.BoolVar(&cfg.advertisedNames, "advertised-names", false, "Use the advertised local name of devices without a configured name")
+	flag.BoolVar(&cfg.exportFahrenheit, "export-fahrenheit", false, "Also export the temperature in degrees Fahrenheit, as btl_sensorbug_temperature_f")
+	flag.BoolVar(&cfg.exportBattRatio, "export-battery-ratio", false, "Also export the battery level as a 0 to 1 fraction, as btl_sensorbug_battery_ratio")
+	flag.BoolVar(&cfg.exportRawTemp, "export-raw-temp", false, "Also export the uncalibrated temperature of devices with a configured temperature offset")
+	flag.IntVar(&cfg.discoBuffer, "disco-buffer", 16, "Size of the discovery channel buffer")
+	flag.IntVar(&cfg.maxDevices, "max-devices", 0, "Maximum number of tracked devices (0 for unlimited)")
+	flag.DurationVar(&cfg.forgetAfter, "forget-after", time.Hour, "With -max-devices reached, a tracked device not seen for this long gives up its slot to a new device (0 to never)")
+	startupTimeout := flag.Duration("startup-timeout", 30*time.Second, "Exit if the adapter has not powered on within this time (0 to wait forever)")
+	logTimestamps := flag.Bool("log-timestamps", false, "Include timestamps in log output")
+	useSyslog := flag.Bool("syslog", false, "Log to syslog instead of stdout")
+	syslogFacility := flag.String("syslog-facility", "daemon", "Syslog facility")
+	syslogTag := flag.String("syslog-tag", "btl", "Syslog tag")
+	tui := flag.Bool("tui", false, "Show a live updating table of devices, with the latest log lines below it, instead of log output")
+	var aws awsIoTConfig
+	flag.StringVar(&aws.endpoint, "aws-iot-endpoint", "", "AWS IoT Core endpoint to publish readings to (host[:port])")
+	flag.StringVar(&aws.clientID, "aws-iot-client-id", defaultClientID(), "AWS IoT Core MQTT client ID")
+	flag.StringVar(&aws.certFile, "aws-iot-cert", "", "AWS IoT Core client certificate file")
+	flag.StringVar(&aws.keyFile, "aws-iot-key", "", "AWS IoT Core client private key file")
+	flag.StringVar(&aws.caFile, "aws-iot-ca", "", "AWS IoT Core root CA file (system roots if empty)")
+	flag.StringVar(&aws.topic, "aws-iot-topic", "btl/{{.Device}}", "AWS IoT Core topic template")
+	flag.BoolVar(&aws.shadow, "aws-iot-shadow", false, "Publish readings as device shadow updates")
+	snmpListen := flag.String("snmp-listen", "", "UDP address to serve the device table to SNMP v2c requests on (e.g. :161)")
+	snmpCommunity := flag.String("snmp-community", "public", "SNMP community")
+	snmpOID := flag.String("snmp-oid", snmpDefaultOID, "Base OID of the SNMP device table")
+	azureConnString := flag.String("azure-iot-connection-string", "", "Azure IoT Hub device connection string (HostName=...;DeviceId=...;SharedAccessKey=...) to publish readings as that device")
+	azureTokenTTL := flag.Duration("azure-iot-token-ttl", time.Hour, "Lifetime of the Azure IoT Hub SAS tokens; the connection is renewed with a new token when one expires")
+	var broker mqttConfig
+	flag.StringVar(&broker.broker, "mqtt-broker", "", "MQTT broker URL to publish readings to (tcp://host[:port], or mqtts://host[:port] for TLS)")
+	flag.StringVar(&broker.clientID, "mqtt-client-id", defaultClientID(), "MQTT client ID")
+	flag.StringVar(&broker.username, "mqtt-username", "", "MQTT username")
+	flag.StringVar(&broker.password, "mqtt-password", "", "MQTT password")
+	flag.StringVar(&broker.caFile, "mqtt-ca", "", "MQTT broker CA certificate file (system roots if empty)")
+	flag.StringVar(&broker.certFile, "mqtt-cert", "", "MQTT client certificate file, if the broker requires one")
+	flag.StringVar(&broker.keyFile, "mqtt-key", "", "MQTT client private key file")
+	flag.StringVar(&broker.topic, "mqtt-topic", "btl/{{.Device}}", "MQTT topic template")
+	mqttEncoding := flag.String("mqtt-encoding", "json", "Encoding of the MQTT payloads, json or protobuf")
+	deviceRegex := flag.String("device-regex", "", "Only process devices whose ID matches this regular expression, in addition to those in the config file")
+	flag.BoolVar(&cfg.idRegexInvert, "device-regex-invert", false, "Only process devices whose ID does not match -device-regex, in addition to those in the config file")
+	serviceUUIDs := flag.String("service-uuid", "", "Only process SensorBugs that also advertise one of these service UUIDs (comma separated)")
+	flag.Parse()
+
 	log.SetOutput(os.Stdout)
 	log.SetFlags(0)
+	if *logTimestamps {
+		log.SetFlags(log.LstdFlags)
+	}
+	if *useSyslog {
+		w, err := openSyslog(*syslogFacility, *syslogTag)
+		if err != nil {
+			log.Fatalln("Syslog:", err)
+		}
+		log.SetOutput(w)
+		// Syslog adds its own timestamps
+		log.SetFlags(0)
+	}
+
+	if cfg.discoBuffer < 0 {
+		log.Fatalln("Discovery buffer size must not be negative")
+	}
+	if cfg.httpAuth != "" && !strings.Contains(cfg.httpAuth, ":") {
+		log.Fatalln("HTTP auth must be given as user:password")
+	}
+	labels, err := parseLabelSet(*readingLabels)
+	if err != nil {
+		log.Fatalln("Labels:", err)
+	}
+	cfg.labels = labels
+	registerReadingGauges(labels.names())
+	if cfg.sinkQueue < 0 {
+		log.Fatalln("Sink queue size must not be negative")
+	}
+	if *rateLimit < 0 || *rateLimitDevice < 0 {
+		log.Fatalln("Rate limits must not be negative")
+	}
+	if *humType > 0x3f {
+		log.Fatalln("Humidity field type must be in the range 0-63")
+	}
+	humidityType = byte(*humType)
+	if temperatureScale <= 0 {
+		log.Fatalln("Temperature scale must be positive")
+	}
+	tempStep.Set(temperatureScale)
+	if cfg.tempPrecision < 0 {
+		log.Fatalln("Temperature precision must not be negative")
+	}
+	if *logTemplate != defaultLogTemplate {
+		tpl, err := parseLogTemplate(*logTemplate)
+		if err != nil {
+			log.Fatalln("Log template:", err)
+		}
+		cfg.logTemplate = tpl
+	}
+	switch *scanType {
+	case "active":
+	case "passive":
+		log.Fatalln("Passive scanning is not supported: scannable advertisements, such as those from SensorBugs, are only delivered along with their scan response, which passive scanning never requests")
+	default:
+		log.Fatalf("Unknown scan type %q\n", *scanType)
+	}
+	if display.fahrenheit, err = parseDisplayUnit(*displayUnit); err != nil {
+		log.Fatalln("Display unit:", err)
+	}
+	if display.precision < 0 {
+		log.Fatalln("Display precision must not be negative")
+	}
+	switch cfg.explain {
+	case "off", "matching", "all":
+	default:
+		log.Fatalf("Unknown explain mode %q\n", cfg.explain)
+	}
+	switch *overdueOn {
+	case "seen":
+	case "temperature":
+		cfg.overdueOnTemp = true
+	default:
+		log.Fatalf("Unknown overdue mode %q\n", *overdueOn)
+	}
+	switch *failMode {
+	case "strict":
+	case "resilient":
+		cfg.resilient = true
+	default:
+		log.Fatalf("Unknown fail mode %q\n", *failMode)
+	}
+	switch *summaryMode {
+	case "absolute":
+	case "delta":
+		cfg.summaryDelta = true
+	default:
+		log.Fatalf("Unknown summary mode %q\n", *summaryMode)
+	}
+
+	if *decode != "" {
+		os.Exit(decodeHex(*decode))
+	}
+	filter, err := parseServiceFilter(*serviceUUIDs)
+	if err != nil {
+		log.Fatalln("Service filter:", err)
+	}
+	cfg.services = filter
+	if *deviceRegex != "" {
+		cfg.idRegex, err = regexp.Compile(*deviceRegex)
+		if err != nil {
+			log.Fatalln("Device regex:", err)
+		}
+	}
+	cfg.disabled, err = parseFieldFilter(*disableFields)
+	if err != nil {
+		log.Fatalln("Disabled fields:", err)
+	}
+	if *checkConfigPath != "" {
+		os.Exit(checkConfig(*checkConfigPath, flagProblems(*listenAddr)))
+	}
+	var sinkFilters map[string]sinkFilter
+	if *configPath != "" {
+		file, err := loadConfigFile(*configPath)
+		if err != nil {
+			log.Fatalln("Config:", err)
+		}
+		cfg.devices = file.Devices
+		sinkFilters = file.Sinks
+		cfg.configPath = *configPath
+	}
+	pollDevices := cfg.devices
+	cfg.configuredIDs = make(map[string]bool, len(cfg.devices))
+	for id := range cfg.devices {
+		cfg.configuredIDs[id] = true
+	}
+	if *anonymize {
+		cfg.anon, err = newAnonymizer(*anonymizeKey, *anonymizeMap)
+		if err != nil {
+			log.Fatalln("Anonymize:", err)
+		}
+		cfg.devices = cfg.anon.devices(cfg.devices)
+	}
+	for name, f := range sinkFilters {
+		if cfg.sinkFilters == nil {
+			cfg.sinkFilters = make(map[string]sampleFilter)
+		}
+		// Already validated when loading the config file.
+		cfg.sinkFilters[name], _ = f.parse(cfg.anon)
+	}
+
+	// Bind the listener before touching the adapter, so that a port
+	// conflict fails cleanly at startup.
+	var l net.Listener
+	if *listenAddr != "" {
+		var err error
+		l, err = listen(*listenAddr)
+		if err != nil {
+			log.Fatalln("HTTP listen:", err)
+		}
+		log.Println("Listening on", l.Addr())
+	}
 
 	d, err := gatt.NewDevice(option.DefaultServerOptions...)
 	if err != nil {
 		log.Fatalln("Failed to open device:", err)
 	}
 
-	s := newState()
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *gatewayLabel {
+		gatherer = labelGatherer{gatherer, prometheus.Labels{"gateway": cfg.gateway}}
+	} else {
+		cfg.gateway = ""
+	}
+
+	s := newState(cfg)
+	gatherer = lockedGatherer{gatherer, &s.mut}
+	if *rateLimit > 0 || *rateLimitDevice > 0 {
+		s.limiter = newRateLimiter(*rateLimit, *rateLimitDevice)
+	}
+	if *mergeTTL > 0 {
+		s.merger = newAdvMerger(*mergeTTL)
+	}
+
+	if cfg.stateFile != "" {
+		if cfg.stateInterval <= 0 {
+			log.Fatalln("State save interval must be positive")
+		}
+		saved, err := loadState(cfg.stateFile)
+		switch {
+		case err == nil:
+			s.restore(saved)
+			log.Printf("Restored state for %d devices\n", len(s.updates))
+		case os.IsNotExist(err):
+		default:
+			log.Fatalln("Loading state:", err)
+		}
+	}
+
+	if *webhookURL != "" {
+		if *webhookQueue < 0 {
+			log.Fatalln("Webhook queue size must not be negative")
+		}
+		s.alerts = newWebhook(*webhookURL, *webhookQueue, *webhookRetries, *webhookFailures, *webhookCooldown)
+	}
+
+	if aws.endpoint != "" {
+		sink, err := newAWSIoTSink(aws)
+		if err != nil {
+			log.Fatalln("AWS IoT:", err)
+		}
+		s.addSink("aws-iot", sink)
+	}
+
+	if *azureConnString != "" {
+		azure, err := parseAzureConnectionString(*azureConnString, *azureTokenTTL)
+		if err != nil {
+			log.Fatalln("Azure IoT:", err)
+		}
+		sink, err := newAzureIoTSink(azure)
+		if err != nil {
+			log.Fatalln("Azure IoT:", err)
+		}
+		s.addSink("azure-iot", sink)
+	}
+
+	if broker.broker != "" {
+		broker.encoding, err = parseSampleEncoding(*mqttEncoding)
+		if err != nil {
+			log.Fatalln("MQTT:", err)
+		}
+		sink, err := newBrokerSink(broker)
+		if err != nil {
+			log.Fatalln("MQTT:", err)
+		}
+		s.addSink("mqtt", sink)
+	}
+
+	if *fifoPath != "" {
+		enc, err := parseSampleEncoding(*fifoEncoding)
+		if err != nil {
+			log.Fatalln("FIFO:", err)
+		}
+		sink, err := newFIFOSink(*fifoPath, enc)
+		if err != nil {
+			log.Fatalln("FIFO:", err)
+		}
+		s.addSink("fifo", sink)
+	}
+
+	if *lokiURL != "" {
+		if *lokiInterval <= 0 {
+			log.Fatalln("Loki push interval must be positive")
+		}
+		s.addSink("loki", newLokiSink(*lokiURL, *lokiInterval, cfg.logTemplate))
+	}
+
+	if *openTSDBURL != "" {
+		if *openTSDBInterval <= 0 {
+			log.Fatalln("OpenTSDB push interval must be positive")
+		}
+		s.addSink("opentsdb", newOpenTSDBSink(*openTSDBURL, *openTSDBInterval))
+	}
+
+	if *remoteWriteURL != "" {
+		if *remoteWriteInterval <= 0 {
+			log.Fatalln("Remote write interval must be positive")
+		}
+		go newRemoteWriter(*remoteWriteURL, *remoteWriteInterval, gatherer).run()
+	}
+
+	if *snmpListen != "" {
+		base, err := parseOID(*snmpOID)
+		if err != nil {
+			log.Fatalln("SNMP:", err)
+		}
+		conn, err := net.ListenPacket("udp", *snmpListen)
+		if err != nil {
+			log.Fatalln("SNMP listen:", err)
+		}
+		log.Println("SNMP agent listening on", conn.LocalAddr())
+		go s.serveSNMP(conn, *snmpCommunity, base)
+	}
+
+	if *textfileDir != "" {
+		if *textfileInterval <= 0 {
+			log.Fatalln("Textfile interval must be positive")
+		}
+		if fi, err := os.Stat(*textfileDir); err != nil {
+			log.Fatalln("Textfile:", err)
+		} else if !fi.IsDir() {
+			log.Fatalln("Textfile:", *textfileDir, "is not a directory")
+		}
+		go writeTextfiles(*textfileDir, *textfileInterval, gatherer)
+	}
+
+	s.startSinks(*sinkWorkers)
 
+	// gatt keeps the handlers for the life of the device, across adapter
+	// resets, so they are only registered once.
 	d.Handle(gatt.PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
 		s.disco <- discovery{p, a, rssi}
 	}))
 
-	if err := d.Init(onStateChanged); err != nil {
+	poll, err := newPoller(pollDevices, cfg.anon)
+	if err != nil {
+		log.Fatalln("Config:", err)
+	}
+	if len(poll.targets) > 0 {
+		s.poller = poll
+		d.Handle(
+			gatt.PeripheralConnected(poll.onConnected),
+			gatt.PeripheralDisconnected(poll.onDisconnected),
+		)
+	}
+
+	var once sync.Once
+	poweredOn := make(chan struct{})
+	initStart := time.Now()
+	stateChanged := func(d gatt.Device, st gatt.State) {
+		if st == gatt.StatePoweredOn {
+			once.Do(func() {
+				adapterStartup.Set(time.Since(initStart).Seconds())
+				close(poweredOn)
+			})
+		}
+		onStateChanged(d, st, *allowDuplicates)
+	}
+
+	if err := d.Init(stateChanged); err != nil {
 		log.Fatalln("Failed to init device:", err)
 	}
 
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		if err := http.ListenAndServe(":9298", nil); err != nil {
-			log.Fatalln("HTTP listen:", err)
+	s.restartScan = func() {
+		d.StopScanning()
+		d.Scan([]gatt.UUID{}, *allowDuplicates)
+		setScanning(true)
+	}
+
+	if *startupTimeout > 0 {
+		go func() {
+			select {
+			case <-poweredOn:
+			case <-time.After(*startupTimeout):
+				if !cfg.resilient {
+					fatalf("Adapter did not power on within %v, giving up\n", *startupTimeout)
+				}
+				log.Printf("Warning: adapter did not power on within %v, still waiting\n", *startupTimeout)
+			}
+		}()
+	}
+
+	handler := s.handler(gatherer, *openMetrics)
+	if *accessLogs {
+		handler = accessLog(handler)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	if l != nil {
+		go serveHTTP(srv, l, *listenAddr, cfg.resilient)
+	}
+
+	if *tui {
+		// Log lines are shown below the table, except with syslog,
+		// where they keep going.
+		var logs *tuiLog
+		if !*useSyslog {
+			logs = new(tuiLog)
+			log.SetOutput(logs)
+			atomic.StoreInt32(&tuiLogging, 1)
 		}
+		go s.runTUI(os.Stdout, time.Second, logs)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		log.Println("Exit on interrupt")
+		stop()
 	}()
 
 	log.Println("Running")
-	s.serve()
+	s.serve(ctx)
+
+	// Closing the server closes the listener, which also removes a Unix
+	// socket
+	srv.Close()
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	s.drainSinks(drainCtx)
+	cancel()
 
 	d.StopScanning()
-	d.Stop()
+	setScanning(false)
+	if err := d.Stop(); err != nil {
+		log.Println("Stopping device:", err)
+		adapterErrors.WithLabelValues("stop").Inc()
+	}
+}
+
+// dependentFlags maps flags to the flag they need to be set to have an
+// effect.
+var dependentFlags = map[string]string{
+	"webhook-queue":         "webhook-url",
+	"webhook-retries":       "webhook-url",
+	"webhook-failures":      "webhook-url",
+	"webhook-cooldown":      "webhook-url",
+	"remote-write-interval": "remote-write-url",
+	"loki-interval":         "loki-url",
+	"opentsdb-interval":     "opentsdb-url",
+	"textfile-interval":     "textfile",
+	"mqtt-client-id":        "mqtt-broker",
+	"mqtt-username":         "mqtt-broker",
+	"mqtt-password":         "mqtt-broker",
+	"mqtt-ca":               "mqtt-broker",
+	"mqtt-cert":             "mqtt-broker",
+	"mqtt-key":              "mqtt-broker",
+	"mqtt-topic":            "mqtt-broker",
+	"mqtt-encoding":         "mqtt-broker",
+	"fifo-encoding":         "fifo",
+	"anonymize-key":         "anonymize",
+	"anonymize-map":         "anonymize",
+	"flatline-updates":      "flatline-window",
+	"state-interval":        "state-file",
+	"azure-iot-token-ttl":   "azure-iot-connection-string",
+	"snmp-community":        "snmp-listen",
+	"snmp-oid":              "snmp-listen",
+	"device-regex-invert":   "device-regex",
+}
+
+// flagProblems returns problems with the combination of command line
+// flags, for -check-config. Individual flag values have already been
+// checked by then.
+func flagProblems(listenAddr string) []string {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var problems []string
+	for name, needs := range dependentFlags {
+		if !set[name] {
+			continue
+		}
+		switch flag.Lookup(needs).Value.String() {
+		case "", "false", "0s":
+			problems = append(problems, fmt.Sprintf("-%s has no effect without -%s", name, needs))
+		}
+	}
+	sort.Strings(problems)
+	if listenAddr != "" && !strings.HasPrefix(listenAddr, "unix:") {
+		if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("-listen: %v", err))
+		}
+	}
+	return problems
+}
+
+// decodeHex parses a single hex encoded advertisement payload and prints
+// the result, returning the process exit code.
+func decodeHex(s string) int {
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		fmt.Println("Invalid hex:", err)
+		return 1
+	}
+	r, err := Parse(data)
+	if err != errNoMatch {
+		// A partial reading is still useful when the data is truncated
+		fmt.Println(r)
+		bs, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(bs))
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
 }
 
-func onStateChanged(d gatt.Device, s gatt.State) {
+func hostname() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+func defaultClientID() string {
+	return "btl-" + hostname()
+}
+
+// scanningSince is the time, in nanoseconds since monoBase, when scanning
+// last started, or zero when not scanning.
+var scanningSince int64
+
+func setScanning(on bool) {
+	if on {
+		atomic.StoreInt64(&scanningSince, monoNanos(time.Now()))
+		scanningActive.Set(1)
+	} else {
+		atomic.StoreInt64(&scanningSince, 0)
+		scanningActive.Set(0)
+	}
+}
+
+// onStateChanged starts scanning when the adapter powers on. With
+// allowDuplicates we receive every advertisement a device sends; without
+// it the controller filters repeats, which lowers CPU and radio load at the
+// cost of fewer updates.
+func onStateChanged(d gatt.Device, s gatt.State, allowDuplicates bool) {
 	log.Println("State:", s)
 	switch s {
 	case gatt.StatePoweredOn:
 		log.Println("scanning...")
-		d.Scan([]gatt.UUID{}, true)
+		d.Scan([]gatt.UUID{}, allowDuplicates)
+		setScanning(true)
 		return
 	default:
 		log.Println("Stopping scan")
 		d.StopScanning()
+		setScanning(false)
 	}
 }
 
+type config struct {
+	discoBuffer      int
+	maxDevices       int
+	forgetAfter      time.Duration // with maxDevices, when a silent device's slot is freed
+	services         serviceFilter
+	devices          map[string]deviceConfig
+	gateway          string // included in sink payloads when set
+	exportUnknown    bool
+	watchdog         time.Duration
+	stateFile        string
+	stateInterval    time.Duration
+	summaryDelta     bool
+	exportTxPower    bool
+	txPower          int
+	scrapeWarn       time.Duration
+	logTemplate      *template.Template
+	sinkQueue        int
+	sinkFilters      map[string]sampleFilter // by sink name
+	minSamples       int
+	minSamplesWindow time.Duration
+	resilient        bool // restart failed subsystems instead of exiting
+	warmup           time.Duration
+	comfort          comfortConfig
+	disabled         fieldFilter
+	idRegex          *regexp.Regexp // nil to process all devices
+	idRegexInvert    bool
+	configuredIDs    map[string]bool // real IDs of the devices in the config file
+	historySize      int
+	anon             *anonymizer // nil unless device IDs are anonymized
+	debug            bool
+	explain          string // off, matching or all
+	scanRestart      time.Duration
+	summaryRSSI      bool
+	tempPrecision    float64
+	alertBattery     int
+	flatlineWindow   time.Duration
+	flatlineUpdates  int
+	aggregateWindow  time.Duration
+	publishOnChange  bool
+	overdueOnTemp    bool // overdue timeouts run from the last temperature, not the last advertisement
+	nearbyWindow     time.Duration
+	newGrace         time.Duration
+	labels           labelSet
+	exportRawTemp    bool
+	exportFahrenheit bool
+	exportBattRatio  bool
+	advertisedNames  bool   // fall back to the advertised local name
+	configPath       string // where runtime name changes are saved, if set
+	httpAuth         string // user:password required for /metrics and /names, if set
+}
+
 type state struct {
-	updates map[string]*update
-	disco   chan discovery
+	// lastScrape is the time of the last /metrics request in nanoseconds
+	// since monoBase, accessed atomically. It's first in the struct to
+	// guarantee 64 bit alignment on 32 bit platforms.
+	lastScrape int64
+
+	mut          sync.Mutex // protects updates, and held while gathering metrics
+	cfg          config
+	updates      map[string]*update
+	disco        chan discovery
+	dump         chan struct{}
+	sinks        []*sinkQueue
+	alerts       *webhook
+	poller       *poller
+	merger       *advMerger
+	limiter      *rateLimiter
+	restartScan  func() // stops and restarts scanning
+	full         bool   // we've warned about hitting the device limit
+	started      time.Time
+	lastAny      time.Time // last advertisement of any kind
+	scrapeWarned bool
+	overdue      map[string]bool
+	sightings    map[string]*sighting // devices not yet tracked
+	fieldTimes   map[fieldKey]*fieldTiming
+	advNames     map[string]string          // last non-empty advertised name per device
+	snapshots    [2]readingSnapshot         // the previous and latest, for /debug/diff
+	nearby       map[string]time.Time       // last seen time of every device, with -nearby-window
+	forgotten    map[string]forgottenDevice // recently dropped devices, within -new-grace
+}
+
+// forgottenDevice is what we remember about a device after it has been
+// dropped from tracking, so that it isn't announced as new if it soon
+// comes back.
+type forgottenDevice struct {
+	firstSeen, lastSeen time.Time
+}
+
+// sighting counts the samples from a device that has not yet sent enough
+// to be tracked.
+type sighting struct {
+	count int
+	first time.Time
+}
+
+// fieldKey identifies a field type from a given device.
+type fieldKey struct {
+	device, field string
+}
+
+// fieldTiming is when a field was last received from a device and the
+// time since the previous time it was received.
+type fieldTiming struct {
+	last     time.Time
+	interval time.Duration
 }
 
 type update struct {
-	message string
-	changed bool
+	message    string
+	changed    bool
+	firstSeen  time.Time
+	lastSeen   time.Time
+	lastTemp   time.Time // last reading with a temperature
+	reading    Reading
+	temp       tempStats
+	fields     map[string]bool // every field type seen from the device
+	battery    batteryHistory
+	lightCfg   []string        // current btl_sensorbug_light_info labels
+	probes     int             // number of btl_sensorbug_probe_temperature_c channels exported
+	rawTypes   map[string]bool // btl_sensorbug_raw type labels exported
+	formats    map[string]bool // btl_sensorbug_unknown_format_total format labels counted
+	rssi       int
+	rssiStats  rssiStats // since the last periodic summary
+	history    sampleHistory
+	collisions collisionDetector
+	flatline   flatline
+	seq        uint64 // of the last published sample
+	published  string // message of the last published sample, with -publish-on-change
+	aggregate  readingMean
+	status     deviceStatus // of the last exported reading
+	// raw is the last manufacturer data and undecoded what was left of
+	// it after parsing, kept in debug mode
+	raw, undecoded []byte
+	// summarized is the reading at the last delta mode summary
+	summarized *Reading
+}
+
+// tempStats are running temperature statistics for a device.
+type tempStats struct {
+	min, max, sum float64
+	count         int
+}
+
+func (t *tempStats) add(v float64) {
+	if t.count == 0 || v < t.min {
+		t.min = v
+	}
+	if t.count == 0 || v > t.max {
+		t.max = v
+	}
+	t.sum += v
+	t.count++
+}
+
+func (t tempStats) avg() float64 {
+	if t.count == 0 {
+		return 0
+	}
+	return t.sum / float64(t.count)
+}
+
+// rssiStats are the RSSI extremes and mean over a summary interval.
+type rssiStats struct {
+	min, max, sum int
+	count         int
+}
+
+func (r *rssiStats) add(v int) {
+	if r.count == 0 || v < r.min {
+		r.min = v
+	}
+	if r.count == 0 || v > r.max {
+		r.max = v
+	}
+	r.sum += v
+	r.count++
+}
+
+func (r rssiStats) avg() float64 {
+	return float64(r.sum) / float64(r.count)
 }
 
 type discovery struct {
@@ -94,114 +1045,737 @@ type discovery struct {
 	rssi   int
 }
 
-func newState() *state {
+func newState(cfg config) *state {
 	return &state{
-		updates: make(map[string]*update),
-		disco:   make(chan discovery, 16),
+		cfg:        cfg,
+		updates:    make(map[string]*update),
+		disco:      make(chan discovery, cfg.discoBuffer),
+		dump:       make(chan struct{}, 1),
+		started:    time.Now(),
+		overdue:    make(map[string]bool),
+		sightings:  make(map[string]*sighting),
+		fieldTimes: make(map[fieldKey]*fieldTiming),
+		advNames:   make(map[string]string),
+		nearby:     make(map[string]time.Time),
+		forgotten:  make(map[string]forgottenDevice),
 	}
 }
 
-func (s *state) serve() {
+// serve processes discoveries and periodic tasks until the context is
+// cancelled.
+func (s *state) serve(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	checks := time.NewTicker(time.Minute)
+	defer checks.Stop()
+
+	var saves <-chan time.Time
+	if s.cfg.stateFile != "" {
+		t := time.NewTicker(s.cfg.stateInterval)
+		defer t.Stop()
+		saves = t.C
+		defer s.save()
+	}
+
+	var scanRestarts <-chan time.Time
+	if s.cfg.scanRestart > 0 {
+		t := time.NewTicker(s.cfg.scanRestart)
+		defer t.Stop()
+		scanRestarts = t.C
+	}
+
+	var aggregates <-chan time.Time
+	if s.cfg.aggregateWindow > 0 {
+		t := time.NewTicker(s.cfg.aggregateWindow)
+		defer t.Stop()
+		aggregates = t.C
+	}
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+
+	discoCapacity.Set(float64(cap(s.disco)))
+	heartbeat.Set(float64(time.Now().Unix()))
 
 	for {
 		select {
 		case disco := <-s.disco:
+			discoDepth.Set(float64(len(s.disco)))
+			s.mut.Lock()
 			s.onDiscovery(disco.periph, disco.advert, disco.rssi)
+			s.mut.Unlock()
 		case <-ticker.C:
-			for id, update := range s.updates {
-				if update.changed {
-					log.Printf("%s: %s\n", id, update.message)
-					update.changed = false
-				}
+			discoDepth.Set(float64(len(s.disco)))
+			s.mut.Lock()
+			s.logSummary(false)
+			s.takeSnapshot(time.Now())
+			s.mut.Unlock()
+		case t := <-checks.C:
+			heartbeat.Set(float64(t.Unix()))
+			s.mut.Lock()
+			s.checkOverdue(time.Now())
+			s.checkWatchdog(time.Now())
+			s.checkScrapes(time.Now())
+			s.compactSightings(time.Now())
+			s.compactForgotten(time.Now())
+			s.countNearby(time.Now())
+			if s.merger != nil {
+				s.merger.expire(time.Now())
+			}
+			if s.limiter != nil {
+				s.limiter.expire(time.Now())
+			}
+			s.mut.Unlock()
+		case t := <-aggregates:
+			s.mut.Lock()
+			s.emitAggregates(t)
+			s.mut.Unlock()
+		case <-saves:
+			s.save()
+		case <-scanRestarts:
+			if atomic.LoadInt64(&scanningSince) != 0 {
+				log.Println("Restarting scan")
+				scanRestartsTotal.Inc()
+				// As for the watchdog, don't block on the adapter
+				go s.restartScan()
 			}
-		case <-sigs:
-			log.Println("Exit on interrupt")
+		case <-usr2:
+			s.mut.Lock()
+			s.resetAll()
+			s.mut.Unlock()
+			log.Println("Reset all devices and metrics on SIGUSR2")
+		case <-usr1:
+			s.mut.Lock()
+			s.logSummary(true)
+			s.mut.Unlock()
+		case <-s.dump:
+			s.mut.Lock()
+			s.logSummary(true)
+			s.mut.Unlock()
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// save writes the device state to the state file.
+func (s *state) save() {
+	s.mut.Lock()
+	saved := s.snapshot()
+	s.mut.Unlock()
+	if err := saveState(s.cfg.stateFile, saved); err != nil {
+		log.Println("Saving state:", err)
+	}
+}
+
+// logSummary logs the current message for each device that has changed
+// since the last summary, or for all devices if all is set.
+//
+// In delta summary mode the periodic summary instead shows how much each
+// value changed since the previous summary. Dumps always show the current
+// values.
+func (s *state) logSummary(all bool) {
+	for id, update := range s.updates {
+		if all || update.changed {
+			msg := update.message
+			if s.cfg.summaryDelta && !all {
+				if update.summarized != nil {
+					msg = deltaString(*update.summarized, update.reading)
+				}
+				r := update.reading
+				update.summarized = &r
+			}
+			if s.cfg.summaryRSSI && update.rssiStats.count > 0 {
+				r := update.rssiStats
+				msg += fmt.Sprintf(" rssi:%d/%.0f/%d", r.min, r.avg(), r.max)
+			}
+			log.Printf("%s: %s\n", id, msg)
+			update.changed = false
+		}
+		if !all {
+			update.rssiStats = rssiStats{}
+		}
+	}
+}
+
+// deltaString formats the difference between two readings.
+func deltaString(prev, cur Reading) string {
+	var str strings.Builder
+	fmt.Fprintf(&str, "batt:%+d%%", cur.Battery-prev.Battery)
+	if prev.Temperature != nil && cur.Temperature != nil {
+		fmt.Fprintf(&str, " temp:%s", display.tempDelta(*cur.Temperature-*prev.Temperature))
+	}
+	if prev.Humidity != nil && cur.Humidity != nil {
+		fmt.Fprintf(&str, " rh:%s", display.rhDelta(*cur.Humidity-*prev.Humidity))
+	}
+	return str.String()
+}
+
+// onDiscovery handles an advertisement. It runs on the serve goroutine and
+// updates only in-memory state and metrics; anything involving I/O, such
+// as sinks and alerts, is queued for separate workers so that discovery
+// never waits on it.
 func (s *state) onDiscovery(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
-	if len(a.ManufacturerData) < 7 {
+	if p == nil || a == nil {
+		// Seen from a misbehaving adapter; there's nothing to go on.
+		adapterErrors.WithLabelValues("advertisement").Inc()
 		return
 	}
-	if !bytes.Equal(a.ManufacturerData[:5], []byte{0x85, 0x00, 0x02, 0x00, 0x3c}) {
+	prev := s.lastAny
+	s.lastAny = time.Now()
+	checkClock(prev, s.lastAny)
+	if s.limiter != nil && !s.limiter.allow(p.ID(), s.lastAny) {
 		return
 	}
+	if s.cfg.nearbyWindow > 0 {
+		s.nearby[p.ID()] = s.lastAny
+	}
+	if s.poller != nil {
+		s.poller.maybePoll(p, s.lastAny)
+	}
+	if !s.wantDevice(p.ID()) {
+		return
+	}
+	if s.merger != nil {
+		a = s.merger.merge(p.ID(), a, s.lastAny)
+	}
 
-	batt := int(a.ManufacturerData[5])
-	battery.WithLabelValues(p.ID()).Set(float64(batt))
+	if s.cfg.advertisedNames && a.LocalName != "" {
+		s.cacheAdvertisedName(p.ID(), a)
+	}
 
-	var str strings.Builder
-	fmt.Fprintf(&str, "batt:%d%%", batt)
+	matched := isSensorBug(a.ManufacturerData) && s.cfg.services.matches(a)
+	if s.cfg.explain == "all" && len(a.ManufacturerData) > 0 || s.cfg.explain == "matching" && matched {
+		explain(os.Stderr, s.cfg.anon.id(p.ID()), a.ManufacturerData)
+	}
+	if !matched {
+		return
+	}
+
+	t0 := time.Now()
+	r, rest, err := parse(a.ManufacturerData)
+	parseDuration.Observe(time.Since(t0).Seconds())
+	if err == errNoMatch {
+		return
+	}
+	id := s.cfg.anon.id(p.ID())
+	if err != nil {
+		if s.cfg.debug {
+			log.Printf("%s: parse: %v (data %x, undecoded %x)\n", id, err, a.ManufacturerData, rest)
+		} else {
+			log.Printf("%s: parse: %v\n", id, err)
+		}
+		return
+	}
+	r = s.cfg.disabled.apply(r)
+	if off := s.cfg.devices[id].TempOffset; off != 0 && r.Temperature != nil {
+		raw := *r.Temperature
+		cal := raw + off
+		r.RawTemperature = &raw
+		r.Temperature = &cal
+	}
+	if s.cfg.warmup > 0 && s.lastAny.Sub(s.started) < s.cfg.warmup {
+		warmupSuppressed.Inc()
+		log.Printf("%s: warmup: %s\n", id, s.formatMessage(id, r))
+		return
+	}
+	if !s.confirmed(id) || !s.admit(id, s.lastAny) {
+		return
+	}
 
-	rest := a.ManufacturerData[7:]
-	// fmt.Fprintf(&str, " manuf:%x", rest)
-	for len(rest) > 0 {
-		dataType := rest[0] & 0b00_111111
-		hasData := rest[0]&0b01_000000 != 0
-		hasAlert := rest[0]&0b10_000000 != 0
-		rest = rest[1:]
+	if s.cfg.exportTxPower {
+		txPower.WithLabelValues(id).Set(float64(s.txPowerOf(a)))
+	}
 
-		if hasAlert {
-			rest = rest[1:]
+	now := time.Now()
+	// The exemplar is only visible in the OpenMetrics format
+	readings.WithLabelValues(id).(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{
+		"reading_time": strconv.FormatInt(now.Unix(), 10),
+	})
+
+	res := s.formatMessage(id, r)
+	cur := s.updates[id]
+	if cur == nil {
+		cur = &update{fields: make(map[string]bool), firstSeen: time.Now()}
+		s.updates[id] = cur
+		if g, ok := s.forgotten[id]; ok && time.Since(g.lastSeen) <= s.cfg.newGrace {
+			// Known from before it was forgotten; not news
+			cur.firstSeen = g.firstSeen
+			if s.cfg.debug {
+				log.Printf("%s: seen again: %s\n", id, res)
+			}
+		} else {
+			log.Printf("%s: new: %s\n", id, res)
 		}
-		if !hasData {
-			continue
+		delete(s.forgotten, id)
+		firstSeen.WithLabelValues(id).Set(float64(cur.firstSeen.Unix()))
+	}
+	if r.Format != 0 {
+		format := fmt.Sprintf("0x%02x", r.Format)
+		if cur.formats == nil {
+			cur.formats = make(map[string]bool)
 		}
+		cur.formats[format] = true
+		unknownFormat.WithLabelValues(id, format).Inc()
+	}
+	if s.cfg.aggregateWindow > 0 {
+		cur.aggregate.add(r)
+	} else {
+		s.emit(id, cur, r, now)
+	}
 
-		switch dataType {
-		case 0x01:
-			// Accellerometer
-			// info about alerts only, uninteresting
-			rest = rest[2:]
-
-		case 0x02:
-			// Light
-			isIR := rest[0]&0b1_0_00_00_00 != 0
-			dataResolution := rest[0] & 0b0_0_11_00_00 >> 4
-			dataRange := rest[0] & 0b0_0_00_11_00 >> 2
-			dataLen := rest[0] & 0b0_0_00_00_11
-			var data uint16
-			if dataLen == 2 {
-				data = binary.LittleEndian.Uint16(rest[1:])
-			} else {
-				data = uint16(rest[1])
+	if cur.message != res {
+		cur.message = res
+		cur.changed = true
+	}
+	if cur.collisions.observe(now, r.Temperature, rssi) {
+		idCollisions.WithLabelValues(id).Inc()
+		log.Printf("Warning: %s: readings jump back and forth, possibly several devices with the same ID\n", s.cfg.displayName(id))
+	}
+	cur.lastSeen = time.Now()
+	if r.Temperature != nil {
+		cur.lastTemp = cur.lastSeen
+	}
+	cur.reading = r
+	if s.cfg.debug {
+		cur.raw = append(cur.raw[:0], a.ManufacturerData...)
+		cur.undecoded = append(cur.undecoded[:0], rest...)
+	}
+	cur.rssi = rssi
+	cur.rssiStats.add(rssi)
+	for _, f := range r.Fields {
+		if !cur.fields[f] {
+			cur.fields[f] = true
+			fieldInfo.WithLabelValues(id, f).Set(1)
+		}
+		s.fieldSeen(id, f, cur.lastSeen)
+	}
+	if r.Light != nil {
+		cur.setLightInfo(id, r.Light)
+	}
+	if cur.battery.add(cur.lastSeen, float64(r.Battery)) {
+		if rate, ok := cur.battery.ratePerDay(); ok {
+			batteryRate.WithLabelValues(id).Set(rate)
+		}
+	}
+	if r.Temperature != nil {
+		cur.temp.add(*r.Temperature)
+		airTempMin.WithLabelValues(id).Set(cur.temp.min)
+		airTempMax.WithLabelValues(id).Set(cur.temp.max)
+		if s.cfg.flatlineWindow > 0 {
+			started, ended := cur.flatline.observe(cur.lastSeen, *r.Temperature, s.cfg.flatlineWindow, s.cfg.flatlineUpdates)
+			if started {
+				flatlines.WithLabelValues(id).Inc()
+				log.Printf("Warning: %s: temperature stuck at %s for %v, over %d updates\n", s.cfg.displayName(id), display.temp(*r.Temperature), cur.lastSeen.Sub(cur.flatline.changed).Truncate(time.Second), cur.flatline.updates)
+			} else if ended {
+				log.Printf("%s: temperature changing again\n", s.cfg.displayName(id))
 			}
-			fmt.Fprintf(&str, " light:%v/%d/%d/%d", isIR, dataResolution, dataRange, data)
-			rest = rest[1+int(dataLen):]
+		}
+	}
+}
 
-		case 0x03:
-			// Temperature
-			temp := 0.0625 * float64(int16(binary.LittleEndian.Uint16(rest)))
-			fmt.Fprintf(&str, " temp:%.01f°C", temp)
-			airTemp.WithLabelValues(p.ID()).Set(temp)
-			rest = rest[2:]
+// emit exports a reading: it sets the metrics and publishes the sample to
+// the sinks, unless -publish-on-change is set and it's the same as the last
+// one published.
+func (s *state) emit(id string, cur *update, r Reading, now time.Time) {
+	s.setMetrics(id, r)
+	cur.status = s.cfg.devices[id].status(r)
+	sample := Sample{Device: id, Name: s.name(id), Gateway: s.cfg.gateway, Time: now, Reading: r}
+	publish := true
+	if s.cfg.publishOnChange {
+		// The log message is what update.changed compares, too
+		msg := s.formatMessage(id, r)
+		publish = msg != cur.published
+		cur.published = msg
+	}
+	if publish {
+		cur.seq++
+		sample.Seq = cur.seq
+		s.publish(sample)
+	}
+	if s.cfg.historySize > 0 {
+		cur.history.add(sample, s.cfg.historySize)
+	}
+}
 
-		case 0x2f:
-			// Pairing, don't case
-			rest = rest[1:]
+// setMetrics updates the gauges for the values in a reading. The reading
+// gauges carry the optional labels selected with -labels.
+func (s *state) setMetrics(id string, r Reading) {
+	labels := s.cfg.labels.values(id, s.cfg.devices[id].Group, s.name(id))
+	battery.WithLabelValues(labels...).Set(float64(r.Battery))
+	if s.cfg.exportBattRatio {
+		batteryRatio.WithLabelValues(labels...).Set(float64(r.Battery) / 100)
+	}
+	if r.RawTemperature != nil && s.cfg.exportRawTemp {
+		airTempRaw.WithLabelValues(labels...).Set(*r.RawTemperature)
+	}
+	if r.Temperature != nil {
+		airTemp.WithLabelValues(labels...).Set(*r.Temperature)
+		if s.cfg.exportFahrenheit {
+			airTempF.WithLabelValues(labels...).Set(*r.Temperature*9/5 + 32)
+		}
+		if p := s.cfg.tempPrecision; p > 0 {
+			airTempDisplay.WithLabelValues(labels...).Set(math.Round(*r.Temperature/p) * p)
+		}
+	}
+	cur := s.updates[id]
+	for i, t := range r.Probes {
+		probeTemp.WithLabelValues(id, strconv.Itoa(i+1)).Set(t)
+	}
+	if len(r.Probes) > cur.probes {
+		cur.probes = len(r.Probes)
+	}
+	if r.Humidity != nil {
+		humidity.WithLabelValues(labels...).Set(*r.Humidity)
+	}
+	if l := r.Light; l != nil {
+		light.WithLabelValues(labels...).Set(float64(l.Value))
+		if lux, ok := l.Lux(); ok {
+			illuminance.WithLabelValues(labels...).Set(lux)
+		}
+	}
+	if dev := s.cfg.devices[id]; dev.hasRanges() {
+		status.WithLabelValues(id).Set(float64(dev.status(r)))
+	}
+	if r.Temperature != nil && r.Humidity != nil {
+		comfort.WithLabelValues(id).Set(comfortScore(*r.Temperature, *r.Humidity, s.cfg.comfort))
+	}
+	for _, f := range r.Fields {
+		if _, ok := r.Alerts[f]; !ok {
+			flags.WithLabelValues(id, f+"_alert").Set(0)
+		}
+	}
+	for f := range r.Alerts {
+		flags.WithLabelValues(id, f+"_alert").Set(1)
+	}
+	undecodedBytes.WithLabelValues(id).Set(float64(r.Undecoded))
+	if r.Accel != nil {
+		accelRaw.WithLabelValues(id).Set(float64(*r.Accel))
+	}
+	if s.cfg.exportUnknown {
+		for _, f := range r.Unknown {
+			typ := fmt.Sprintf("0x%02x", f.Type)
+			if cur.rawTypes == nil {
+				cur.rawTypes = make(map[string]bool)
+			}
+			cur.rawTypes[typ] = true
+			rawField.WithLabelValues(id, typ).Set(float64(f.Value))
+		}
+	}
+}
+
+// txPowerOf returns the advertised transmit power, or the configured
+// default if there is none. gatt reports zero both for an absent TX power
+// field and for an actual 0 dBm, so zero is treated as absent. The field is
+// a signed byte, which gatt hands us unsigned.
+func (s *state) txPowerOf(a *gatt.Advertisement) int {
+	if a.TxPowerLevel == 0 {
+		return s.cfg.txPower
+	}
+	return int(int8(a.TxPowerLevel))
+}
 
-		case 0x3f:
-			// Encryption pairing, we're done
-			rest = nil
+// checkOverdue flags configured devices that have not been seen within
+// their timeout. Devices never seen at all are measured from startup.
+func (s *state) checkOverdue(now time.Time) {
+	for id, dev := range s.cfg.devices {
+		if dev.Timeout <= 0 {
+			continue
+		}
+		last := s.started
+		if cur, ok := s.updates[id]; ok {
+			last = cur.lastSeen
+			if s.cfg.overdueOnTemp && !cur.lastTemp.IsZero() {
+				last = cur.lastTemp
+			} else if s.cfg.overdueOnTemp {
+				last = s.started
+			}
+		}
+		late := now.Sub(last) > dev.Timeout
+		if late && !s.overdue[id] {
+			what := "not seen"
+			if s.cfg.overdueOnTemp {
+				what = "no temperature"
+			}
+			log.Printf("%s: overdue, %s for %v\n", s.cfg.displayName(id), what, now.Sub(last).Truncate(time.Second))
+			s.alert(alertEvent{Event: "overdue", Device: id, Name: dev.Name, Time: now, LastSeen: last})
+		} else if !late && s.overdue[id] {
+			log.Printf("%s: no longer overdue\n", s.cfg.displayName(id))
+			s.alert(alertEvent{Event: "recovered", Device: id, Name: dev.Name, Time: now, LastSeen: last})
+		}
+		s.overdue[id] = late
+		if late {
+			overdue.WithLabelValues(id).Set(1)
+		} else {
+			overdue.WithLabelValues(id).Set(0)
 		}
 	}
+}
 
-	res := str.String()
-	cur := s.updates[p.ID()]
-	if cur == nil {
-		cur = &update{}
-		s.updates[p.ID()] = cur
-		log.Printf("%s: new: %s\n", p.ID(), res)
+// checkWatchdog exits the process if we believe we're scanning but
+// haven't received any advertisements for longer than the watchdog
+// interval, so that a supervisor can restart us.
+func (s *state) checkWatchdog(now time.Time) {
+	if s.cfg.watchdog <= 0 {
+		return
 	}
-	if cur.message != res {
-		cur.message = res
-		cur.changed = true
+	since := atomic.LoadInt64(&scanningSince)
+	if since == 0 {
+		return
+	}
+	last := monoTime(since)
+	if s.lastAny.After(last) {
+		last = s.lastAny
+	}
+	if now.Sub(last) <= s.cfg.watchdog {
+		return
+	}
+	if !s.cfg.resilient {
+		fatalf("Watchdog: no advertisements received for %v, exiting\n", now.Sub(last).Truncate(time.Second))
+	}
+	log.Printf("Watchdog: no advertisements received for %v, restarting scan\n", now.Sub(last).Truncate(time.Second))
+	subsystemRestarts.WithLabelValues("scanner").Inc()
+	// Restart from a separate goroutine, as the adapter may be blocked
+	// delivering a discovery to us.
+	atomic.StoreInt64(&scanningSince, monoNanos(now))
+	go s.restartScan()
+}
+
+// checkScrapes warns once if /metrics has not been scraped for longer
+// than the configured interval.
+func (s *state) checkScrapes(now time.Time) {
+	if s.cfg.scrapeWarn <= 0 {
+		return
+	}
+	last := s.started
+	if ns := atomic.LoadInt64(&s.lastScrape); ns != 0 {
+		last = monoTime(ns)
+	}
+	late := now.Sub(last) > s.cfg.scrapeWarn
+	if late && !s.scrapeWarned {
+		log.Printf("Warning: metrics have not been scraped for %v\n", now.Sub(last).Truncate(time.Second))
+	} else if !late && s.scrapeWarned {
+		log.Println("Metrics are being scraped again")
+	}
+	s.scrapeWarned = late
+}
+
+// alert sends an event to the webhook, if one is configured.
+func (s *state) alert(ev alertEvent) {
+	if s.alerts != nil {
+		s.alerts.notify(ev)
+	}
+}
+
+// setLightInfo updates the light configuration info metric, removing the
+// series for the previous configuration if it changed.
+func (cur *update) setLightInfo(id string, l *Light) {
+	labels := []string{id, strconv.FormatBool(l.IR), strconv.Itoa(l.Resolution), strconv.Itoa(l.Range)}
+	if cur.lightCfg != nil {
+		if strings.Join(cur.lightCfg, ",") == strings.Join(labels, ",") {
+			return
+		}
+		lightInfo.DeleteLabelValues(cur.lightCfg...)
+	}
+	lightInfo.WithLabelValues(labels...).Set(1)
+	cur.lightCfg = labels
+}
+
+// resetStats clears the running temperature statistics for all devices.
+func (s *state) resetStats() {
+	for id, cur := range s.updates {
+		cur.temp = tempStats{}
+		airTempMin.DeleteLabelValues(id)
+		airTempMax.DeleteLabelValues(id)
+	}
+}
+
+// resetAll gives a clean slate: it forgets every tracked device and clears
+// all labelled metrics, so that only the devices still in range come back
+// as they advertise. Devices coming back within -new-grace keep their
+// first seen time. The unlabelled process metrics, such as the parse
+// time histogram, are left alone.
+func (s *state) resetAll() {
+	vecs := []interface{ Reset() }{
+		probeTemp, airTempMin, airTempMax, lightInfo, fieldInfo, fieldInterval,
+		rawField, comfort, readings, undecodedBytes, unknownFormat, accelRaw,
+		batteryRate, txPower, firstSeen, subsystemRestarts, idCollisions,
+		flatlines, status, overdue, flags, gattValue, adapterErrors, gattConnections,
+		sinkDropped, webhookEvents, rateLimited, openTSDBPushes,
+	}
+	for _, g := range readingGauges {
+		vecs = append(vecs, *g.vec)
+	}
+	for _, v := range vecs {
+		v.Reset()
+	}
+
+	for id, cur := range s.updates {
+		s.forgotten[id] = forgottenDevice{firstSeen: cur.firstSeen, lastSeen: cur.lastSeen}
+	}
+	s.updates = make(map[string]*update)
+	s.overdue = make(map[string]bool)
+	s.sightings = make(map[string]*sighting)
+	s.fieldTimes = make(map[fieldKey]*fieldTiming)
+	s.advNames = make(map[string]string)
+	s.nearby = make(map[string]time.Time)
+	s.snapshots = [2]readingSnapshot{}
+	s.full = false
+}
+
+// countNearby forgets devices not seen within the nearby window and
+// exports the number remaining.
+func (s *state) countNearby(now time.Time) {
+	if s.cfg.nearbyWindow <= 0 {
+		return
+	}
+	for id, seen := range s.nearby {
+		if now.Sub(seen) > s.cfg.nearbyWindow {
+			delete(s.nearby, id)
+		}
+	}
+	nearby.Set(float64(len(s.nearby)))
+}
+
+// fieldSeen records the arrival of a field from a device and exports the
+// interval since it last arrived.
+func (s *state) fieldSeen(id, field string, now time.Time) {
+	key := fieldKey{id, field}
+	ft := s.fieldTimes[key]
+	if ft == nil {
+		s.fieldTimes[key] = &fieldTiming{last: now}
+		return
+	}
+	interval := now.Sub(ft.last)
+	ft.last = now
+	if interval < 0 {
+		// Only possible if the clock stepped and one of the times lacks
+		// a monotonic reading, which is no interval at all.
+		clockSkew.Inc()
+		return
+	}
+	ft.interval = interval
+	fieldInterval.WithLabelValues(id, field).Set(ft.interval.Seconds())
+}
+
+// confirmed returns true if the device is already tracked or has now sent
+// the minimum number of samples to become tracked. Until then its samples
+// are only counted.
+func (s *state) confirmed(id string) bool {
+	if _, ok := s.updates[id]; ok || s.cfg.minSamples <= 1 {
+		return true
+	}
+	sg := s.sightings[id]
+	if sg == nil {
+		sg = &sighting{first: s.lastAny}
+		s.sightings[id] = sg
+	}
+	sg.count++
+	if sg.count < s.cfg.minSamples {
+		return false
+	}
+	delete(s.sightings, id)
+	return true
+}
+
+// compactSightings forgets devices that didn't send the minimum number of
+// samples within the window after they were first seen, so that passing
+// devices don't accumulate.
+func (s *state) compactSightings(now time.Time) {
+	n := 0
+	for id, sg := range s.sightings {
+		if now.Sub(sg.first) > s.cfg.minSamplesWindow {
+			delete(s.sightings, id)
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("Forgot %d devices that sent fewer than %d samples within %v\n", n, s.cfg.minSamples, s.cfg.minSamplesWindow)
+	}
+}
+
+// compactForgotten drops forgotten devices past the -new-grace period.
+func (s *state) compactForgotten(now time.Time) {
+	for id, g := range s.forgotten {
+		if now.Sub(g.lastSeen) > s.cfg.newGrace {
+			delete(s.forgotten, id)
+		}
+	}
+}
+
+// admit returns true if the device is already tracked or if there is room
+// to start tracking it. With the limit reached, the tracked device seen
+// least recently gives up its slot if it hasn't been seen within
+// -forget-after.
+func (s *state) admit(id string, now time.Time) bool {
+	if _, ok := s.updates[id]; ok {
+		return true
+	}
+	if s.cfg.maxDevices <= 0 || len(s.updates) < s.cfg.maxDevices {
+		s.full = false
+		return true
+	}
+	if s.cfg.forgetAfter > 0 {
+		var oldest string
+		for tid, cur := range s.updates {
+			if oldest == "" || cur.lastSeen.Before(s.updates[oldest].lastSeen) {
+				oldest = tid
+			}
+		}
+		if now.Sub(s.updates[oldest].lastSeen) > s.cfg.forgetAfter {
+			log.Printf("%s: not seen since %s, forgotten to make room for %s\n", oldest, s.updates[oldest].lastSeen.Format(time.RFC3339), id)
+			s.forget(oldest)
+			s.full = false
+			return true
+		}
+	}
+	if !s.full {
+		log.Printf("Warning: device limit (%d) reached, ignoring new devices such as %s\n", s.cfg.maxDevices, id)
+		s.full = true
+	}
+	return false
+}
+
+// forget drops a device from tracking and removes its metrics, remembering
+// it within -new-grace like resetAll does.
+func (s *state) forget(id string) {
+	cur := s.updates[id]
+	s.forgotten[id] = forgottenDevice{firstSeen: cur.firstSeen, lastSeen: cur.lastSeen}
+	delete(s.updates, id)
+	delete(s.overdue, id)
+	delete(s.advNames, id)
+	for f := range cur.fields {
+		delete(s.fieldTimes, fieldKey{id, f})
+		fieldInfo.DeleteLabelValues(id, f)
+		fieldInterval.DeleteLabelValues(id, f)
+		flags.DeleteLabelValues(id, f+"_alert")
+	}
+	for i := 0; i < cur.probes; i++ {
+		probeTemp.DeleteLabelValues(id, strconv.Itoa(i+1))
+	}
+	for typ := range cur.rawTypes {
+		rawField.DeleteLabelValues(id, typ)
+	}
+	for format := range cur.formats {
+		unknownFormat.DeleteLabelValues(id, format)
+	}
+	if cur.lightCfg != nil {
+		lightInfo.DeleteLabelValues(cur.lightCfg...)
+	}
+	if s.poller != nil {
+		s.poller.forget(id)
+	}
+	labels := s.cfg.labels.values(id, s.cfg.devices[id].Group, s.name(id))
+	for _, g := range readingGauges {
+		(*g.vec).DeleteLabelValues(labels...)
+	}
+	for _, v := range []*prometheus.GaugeVec{airTempMin, airTempMax, comfort, undecodedBytes, accelRaw, batteryRate, txPower, firstSeen, status, overdue} {
+		v.DeleteLabelValues(id)
+	}
+	for _, v := range []*prometheus.CounterVec{readings, idCollisions, flatlines} {
+		v.DeleteLabelValues(id)
 	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/photostorm/gatt"
+)
+
+// advMerger fills in the local name and TX power for a device whose
+// advertisement and scan response arrive as separate discoveries, so that
+// the name cache and TX power see them. On Linux gatt already combines the
+// two before we see them. Manufacturer data and services are never
+// borrowed: a discovery carrying only a scan response would otherwise
+// have the previous payload parsed and published again as a new reading.
+type advMerger struct {
+	ttl     time.Duration
+	entries map[string]*mergedAdv
+}
+
+type mergedAdv struct {
+	adv  gatt.Advertisement
+	seen time.Time
+}
+
+func newAdvMerger(ttl time.Duration) *advMerger {
+	return &advMerger{
+		ttl:     ttl,
+		entries: make(map[string]*mergedAdv),
+	}
+}
+
+// merge returns the advertisement with a missing name and TX power filled
+// in from recent discoveries of the same device.
+func (m *advMerger) merge(id string, a *gatt.Advertisement, now time.Time) *gatt.Advertisement {
+	merged := *a
+	if e, ok := m.entries[id]; ok && now.Sub(e.seen) <= m.ttl {
+		prev := e.adv
+		if merged.LocalName == "" {
+			merged.LocalName = prev.LocalName
+		}
+		if merged.TxPowerLevel == 0 {
+			merged.TxPowerLevel = prev.TxPowerLevel
+		}
+	}
+	m.entries[id] = &mergedAdv{adv: merged, seen: now}
+	return &merged
+}
+
+// expire forgets devices not seen within the TTL.
+func (m *advMerger) expire(now time.Time) {
+	for id, e := range m.entries {
+		if now.Sub(e.seen) > m.ttl {
+			delete(m.entries, id)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublishTimeout is how long a publish may wait for the broker to
+// acknowledge it.
+const mqttPublishTimeout = 30 * time.Second
+
+// mqttSink publishes samples as JSON, or protobuf for a generic broker, to
+// an MQTT broker, one topic per device.
+type mqttSink struct {
+	client   mqtt.Client
+	topic    *template.Template
+	shadow   bool // wrap the payload as a device shadow update
+	encoding sampleEncoding
+}
+
+// awsIoTConfig is the connection information for AWS IoT Core, which
+// requires mutually authenticated TLS on port 8883.
+type awsIoTConfig struct {
+	endpoint string
+	clientID string
+	certFile string
+	keyFile  string
+	caFile   string
+	topic    string
+	shadow   bool
+}
+
+// awsShadowTopic is the topic to which device shadow updates are sent.
+const awsShadowTopic = "$aws/things/{{.Device}}/shadow/update"
+
+func newAWSIoTSink(cfg awsIoTConfig) (*mqttSink, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.caFile != "" {
+		pool, err := loadCertPool(cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	host := cfg.endpoint
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "8883")
+	}
+
+	topic := cfg.topic
+	if cfg.shadow {
+		topic = awsShadowTopic
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("ssl://" + host).
+		SetClientID(cfg.clientID).
+		SetTLSConfig(tlsCfg)
+	return newMQTTSink(opts, topic, cfg.shadow)
+}
+
+// mqttConfig is the connection information for a generic MQTT broker,
+// given as a URL with the scheme tcp or mqtt for plain connections and
+// ssl, tls or mqtts for TLS.
+type mqttConfig struct {
+	broker   string
+	clientID string
+	username string
+	password string
+	caFile   string
+	certFile string // optional client certificate, with keyFile
+	keyFile  string
+	topic    string
+	encoding sampleEncoding
+}
+
+func newBrokerSink(cfg mqttConfig) (*mqttSink, error) {
+	u, err := url.Parse(cfg.broker)
+	if err != nil {
+		return nil, fmt.Errorf("broker URL: %w", err)
+	}
+	var secure bool
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		secure = true
+	default:
+		return nil, fmt.Errorf("broker URL: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+
+	opts := mqtt.NewClientOptions().
+		SetClientID(cfg.clientID).
+		SetUsername(cfg.username).
+		SetPassword(cfg.password)
+	if !secure {
+		if cfg.caFile != "" || cfg.certFile != "" {
+			return nil, errors.New("CA and client certificates require a TLS broker URL")
+		}
+		opts.AddBroker("tcp://" + host)
+	} else {
+		tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.certFile != "" || cfg.keyFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			tlsCfg.Certificates = []tls.Certificate{cert}
+		}
+		if cfg.caFile != "" {
+			pool, err := loadCertPool(cfg.caFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsCfg.RootCAs = pool
+		}
+		opts.AddBroker("ssl://" + host).SetTLSConfig(tlsCfg)
+	}
+
+	sink, err := newMQTTSink(opts, cfg.topic, false)
+	if err != nil {
+		return nil, err
+	}
+	sink.encoding = cfg.encoding
+	return sink, nil
+}
+
+func newMQTTSink(opts *mqtt.ClientOptions, topic string, shadow bool) (*mqttSink, error) {
+	tpl, err := template.New("topic").Parse(topic)
+	if err != nil {
+		return nil, fmt.Errorf("parsing topic template: %w", err)
+	}
+
+	opts.SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectTimeout(30 * time.Second).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Println("MQTT: connected")
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("MQTT: connection lost:", err)
+		})
+
+	client := mqtt.NewClient(opts)
+	// With connect retry enabled this returns immediately and the
+	// connection is established in the background.
+	client.Connect()
+
+	return &mqttSink{
+		client: client,
+		topic:  tpl,
+		shadow: shadow,
+	}, nil
+}
+
+func (m *mqttSink) Publish(sample Sample) error {
+	var topic bytes.Buffer
+	if err := m.topic.Execute(&topic, sample); err != nil {
+		return err
+	}
+
+	var bs []byte
+	var err error
+	if m.shadow {
+		bs, err = json.Marshal(map[string]interface{}{
+			"state": map[string]interface{}{
+				"reported": sample,
+			},
+		})
+	} else {
+		bs, err = m.encoding.marshal(sample)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Wait for the broker here, so that while it is unreachable samples
+	// back up in the sink queue, which is bounded, rather than in the
+	// client.
+	token := m.client.Publish(topic.String(), 1, false, bs)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return fmt.Errorf("topic %s: not acknowledged within %v", topic.String(), mqttPublishTimeout)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("topic %s: %w", topic.String(), err)
+	}
+	return nil
+}
+
+// Flush does nothing, as Publish waits for each sample to be acknowledged.
+func (m *mqttSink) Flush(context.Context) error {
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, errors.New("loading CA certificate: no certificates found in " + file)
+	}
+	return pool, nil
+}
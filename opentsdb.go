@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// openTSDBMaxPending is the number of data points buffered between pushes,
+// including those kept from failed pushes. Points beyond this are dropped.
+const openTSDBMaxPending = 50000
+
+var openTSDBPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "btl",
+	Subsystem: "opentsdb",
+	Name:      "pushes_total",
+	Help:      "OpenTSDB pushes by result: success or failure.",
+}, []string{"result"})
+
+// openTSDBSink posts the readings to an OpenTSDB /api/put endpoint,
+// batched on an interval. Each value is its own data point, tagged with
+// the device ID, its configured name as location and the gateway when set.
+// Points from a failed push are kept and sent with the next one.
+type openTSDBSink struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mut     sync.Mutex
+	pending []openTSDBPoint
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"` // milliseconds
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+func newOpenTSDBSink(url string, interval time.Duration) *openTSDBSink {
+	o := &openTSDBSink{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	go o.run()
+	return o
+}
+
+// Publish buffers the sample's data points for the next push.
+func (o *openTSDBSink) Publish(sample Sample) error {
+	points := openTSDBPoints(sample)
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if len(o.pending)+len(points) > openTSDBMaxPending {
+		sinkDropped.WithLabelValues("opentsdb").Inc()
+		return nil
+	}
+	o.pending = append(o.pending, points...)
+	return nil
+}
+
+// Flush pushes the buffered points.
+func (o *openTSDBSink) Flush(ctx context.Context) error {
+	return o.push(ctx)
+}
+
+func (o *openTSDBSink) run() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := o.push(context.Background()); err != nil {
+			log.Println("OpenTSDB:", err)
+		}
+	}
+}
+
+// push sends the buffered points. On failure they are put back in front
+// of anything buffered since, as far as there is room.
+func (o *openTSDBSink) push(ctx context.Context) error {
+	o.mut.Lock()
+	points := o.pending
+	o.pending = nil
+	o.mut.Unlock()
+	if len(points) == 0 {
+		return nil
+	}
+
+	err := o.post(ctx, points)
+	if err == nil {
+		openTSDBPushes.WithLabelValues("success").Inc()
+		return nil
+	}
+	openTSDBPushes.WithLabelValues("failure").Inc()
+
+	o.mut.Lock()
+	if room := openTSDBMaxPending - len(o.pending); len(points) > room {
+		points = points[len(points)-room:]
+	}
+	o.pending = append(points, o.pending...)
+	o.mut.Unlock()
+	return err
+}
+
+func (o *openTSDBSink) post(ctx context.Context, points []openTSDBPoint) error {
+	bs, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// openTSDBPoints returns the data points for the values in the sample,
+// named as the corresponding Prometheus metrics.
+func openTSDBPoints(sample Sample) []openTSDBPoint {
+	tags := map[string]string{"device": openTSDBTag(sample.Device)}
+	if sample.Name != "" {
+		tags["location"] = openTSDBTag(sample.Name)
+	}
+	if sample.Gateway != "" {
+		tags["gateway"] = openTSDBTag(sample.Gateway)
+	}
+	ts := sample.Time.UnixNano() / int64(time.Millisecond)
+	var points []openTSDBPoint
+	add := func(metric string, value float64, tags map[string]string) {
+		points = append(points, openTSDBPoint{Metric: "btl.sensorbug." + metric, Timestamp: ts, Value: value, Tags: tags})
+	}
+
+	r := sample.Reading
+	add("battery_percent", float64(r.Battery), tags)
+	if r.Temperature != nil {
+		add("temperature_c", *r.Temperature, tags)
+	}
+	for i, t := range r.Probes {
+		probeTags := map[string]string{"channel": strconv.Itoa(i + 1)}
+		for k, v := range tags {
+			probeTags[k] = v
+		}
+		add("probe_temperature_c", t, probeTags)
+	}
+	if r.Humidity != nil {
+		add("humidity_percent", *r.Humidity, tags)
+	}
+	if l := r.Light; l != nil {
+		add("light", float64(l.Value), tags)
+		if lux, ok := l.Lux(); ok {
+			add("illuminance_lux", lux, tags)
+		}
+	}
+	return points
+}
+
+// openTSDBTag returns the value with the characters OpenTSDB doesn't
+// allow in tag values replaced by underscores.
+func openTSDBTag(v string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./", r) {
+			return r
+		}
+		return '_'
+	}, v)
+}
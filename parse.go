@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sensorBugPrefix is the start of the manufacturer data for a SensorBug:
+// the BlueRadios company ID followed by the product identifier.
+var sensorBugPrefix = []byte{0x85, 0x00, 0x02, 0x00, 0x3c}
+
+// humidityType is the field type carrying relative humidity, as a little
+// endian unsigned 16 bit value in hundredths of a percent. It is a variable
+// so that it can be adjusted for models that use a different code.
+var humidityType byte = 0x04
+
+// temperatureScale is the size in °C of one step of the signed 16 bit
+// temperature value. It is a variable so that it can be adjusted for
+// models with a different sensor resolution.
+var temperatureScale = 0.0625
+
+// unknownFieldLen is the number of data bytes assumed to follow the header
+// of a field type we don't otherwise decode. Every field type we know of,
+// apart from light (which carries its own length) and pairing, is a two
+// byte little endian value, so this is the best guess for new ones. If the
+// guess is wrong the rest of the advertisement will be misparsed.
+const unknownFieldLen = 2
+
+var (
+	errNoMatch     = errors.New("not a SensorBug advertisement")
+	errTruncated   = errors.New("truncated field")
+	errLightLength = errors.New("light: unsupported data length 3")
+)
+
+// Reading is the decoded contents of a SensorBug advertisement. Fields the
+// advertisement did not carry are nil.
+//
+// None of the field types we know of is a packet or sequence counter, so
+// missed advertisements can't be counted from the data itself; the time
+// between advertisements (btl_sensorbug_field_interval_seconds) is the
+// closest measure. If a counter turns up among the unknown field types it
+// should be decoded here, with gaps counted modulo its width.
+type Reading struct {
+	// Fields lists the fields present in the advertisement, in order.
+	Fields  []string `json:"fields"`
+	Battery int      `json:"battery"`
+	// Format is the byte following the battery level; see Parse.
+	Format      byte     `json:"format,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	// RawTemperature is the temperature before calibration, set when a
+	// calibration offset was applied.
+	RawTemperature *float64 `json:"rawTemperature,omitempty"`
+	Light          *Light   `json:"light,omitempty"`
+	Humidity       *float64 `json:"humidity,omitempty"`
+	// Probes holds the values of any temperature fields after the first,
+	// such as from an external probe, in order.
+	Probes []float64 `json:"probes,omitempty"`
+	// Accel is the raw accelerometer field value; see Parse.
+	Accel *uint16 `json:"accel,omitempty"`
+	// Unknown holds the raw values of field types we don't decode.
+	Unknown []RawField `json:"unknown,omitempty"`
+	// Alerts holds the alert byte of each field whose header has the
+	// alert flag set, by field name as in Fields. These are the only
+	// status flags in the advertisement that we know of: byte 6 is a
+	// format byte (see Parse), not a set of flags, and the meaning of the
+	// alert byte's bits isn't documented, so it's kept whole.
+	Alerts map[string]byte `json:"alerts,omitempty"`
+	// Undecoded is the number of bytes, headers included, taken up by
+	// fields of unknown type. Data after an encryption pairing field is
+	// not counted.
+	Undecoded int `json:"undecoded,omitempty"`
+}
+
+// RawField is the undecoded value of a field of unknown type, assumed to
+// be unknownFieldLen bytes long.
+type RawField struct {
+	Type  byte   `json:"type"`
+	Value uint16 `json:"value"`
+}
+
+// Light is the raw light sensor value along with the sensor configuration
+// needed to interpret it. The value is an unsigned ADC count in every mode;
+// the range and resolution only change its scale.
+type Light struct {
+	IR         bool   `json:"ir"`
+	Resolution int    `json:"resolution"`
+	Range      int    `json:"range"`
+	Value      uint16 `json:"value"`
+}
+
+// isSensorBug returns true if the manufacturer data is long enough to
+// carry a SensorBug header and starts with the SensorBug prefix.
+func isSensorBug(data []byte) bool {
+	return len(data) >= 7 && bytes.Equal(data[:5], sensorBugPrefix)
+}
+
+// Full scale ranges in lux and ADC resolutions in bits, by the value of
+// the light field's range and resolution bits. These follow the Intersil
+// ISL29023 family of ambient light sensors, whose configuration the light
+// field mirrors.
+var (
+	lightRanges      = [4]float64{1000, 4000, 16000, 64000}
+	lightResolutions = [4]uint{16, 12, 8, 4}
+)
+
+// Lux returns the illuminance for the raw light value, as the full scale
+// range divided into 2^resolution steps. In IR mode the value is an
+// infrared count with no lux equivalent, and false is returned.
+func (l Light) Lux() (float64, bool) {
+	if l.IR || l.Range < 0 || l.Range > 3 || l.Resolution < 0 || l.Resolution > 3 {
+		return 0, false
+	}
+	steps := float64(uint64(1) << lightResolutions[l.Resolution])
+	return lightRanges[l.Range] / steps * float64(l.Value), true
+}
+
+// Parse decodes SensorBug manufacturer data. It returns errNoMatch if the
+// data is not from a SensorBug.
+func Parse(data []byte) (Reading, error) {
+	r, _, err := parse(data)
+	return r, err
+}
+
+// parse is Parse, also returning the data left undecoded: what follows an
+// encryption pairing field, or the field that failed to parse.
+func parse(data []byte) (Reading, []byte, error) {
+	if !isSensorBug(data) {
+		return Reading{}, nil, errNoMatch
+	}
+
+	var r Reading
+	r.Battery = int(data[5])
+	r.Fields = []string{"battery"}
+
+	// The byte after the battery level is zero in every advertisement
+	// we know the meaning of. Devices have been seen sending other
+	// values without the fields that follow looking any different, so
+	// we decode them the same way and expose the value for whoever
+	// wants to tell them apart.
+	r.Format = data[6]
+
+	rest := data[7:]
+	for len(rest) > 0 {
+		fieldLen := len(rest)
+		dataType := rest[0] & 0b00_111111
+		hasData := rest[0]&0b01_000000 != 0
+		hasAlert := rest[0]&0b10_000000 != 0
+		rest = rest[1:]
+
+		if hasAlert {
+			if len(rest) < 1 {
+				return r, rest, errTruncated
+			}
+			if r.Alerts == nil {
+				r.Alerts = make(map[string]byte)
+			}
+			r.Alerts[fieldName(dataType)] = rest[0]
+			rest = rest[1:]
+		}
+		if !hasData {
+			continue
+		}
+
+		if dataType == humidityType {
+			if len(rest) < 2 {
+				return r, rest, errTruncated
+			}
+			rh := float64(binary.LittleEndian.Uint16(rest)) / 100
+			r.Humidity = &rh
+			r.Fields = append(r.Fields, "humidity")
+			rest = rest[2:]
+			continue
+		}
+
+		switch dataType {
+		case 0x01:
+			// Accelerometer. The field accompanies motion alerts and its
+			// two data bytes carry no documented orientation or axis
+			// layout, so we keep the little endian value undecoded.
+			if len(rest) < 2 {
+				return r, rest, errTruncated
+			}
+			accel := binary.LittleEndian.Uint16(rest)
+			r.Accel = &accel
+			r.Fields = append(r.Fields, "accel")
+			rest = rest[2:]
+
+		case 0x02:
+			// Light. The low two bits of the configuration byte give the
+			// length of the value that follows: zero means the field
+			// carries no value, and three bytes is not a length the
+			// sensor uses, so treat it as corrupt rather than guess.
+			if len(rest) < 1 {
+				return r, rest, errTruncated
+			}
+			dataLen := int(rest[0] & 0b0_0_00_00_11)
+			if dataLen == 3 {
+				return r, rest, errLightLength
+			}
+			if len(rest) < 1+dataLen {
+				return r, rest, errTruncated
+			}
+			if dataLen > 0 {
+				l := &Light{
+					IR:         rest[0]&0b1_0_00_00_00 != 0,
+					Resolution: int(rest[0] & 0b0_0_11_00_00 >> 4),
+					Range:      int(rest[0] & 0b0_0_00_11_00 >> 2),
+				}
+				if dataLen == 2 {
+					l.Value = binary.LittleEndian.Uint16(rest[1:])
+				} else {
+					l.Value = uint16(rest[1])
+				}
+				r.Light = l
+				r.Fields = append(r.Fields, "light")
+			}
+			rest = rest[1+dataLen:]
+
+		case 0x03:
+			if len(rest) < 2 {
+				return r, rest, errTruncated
+			}
+			// Temperature. Devices with an external probe send a
+			// second field, after the onboard one.
+			temp := temperatureScale * float64(int16(binary.LittleEndian.Uint16(rest)))
+			if r.Temperature == nil {
+				r.Temperature = &temp
+			} else {
+				r.Probes = append(r.Probes, temp)
+			}
+			r.Fields = append(r.Fields, "temp")
+			rest = rest[2:]
+
+		case 0x2f:
+			// Pairing, don't case
+			if len(rest) < 1 {
+				return r, rest, errTruncated
+			}
+			rest = rest[1:]
+
+		case 0x3f:
+			// Encryption pairing, we're done
+			return r, rest, nil
+
+		default:
+			if len(rest) < unknownFieldLen {
+				return r, rest, errTruncated
+			}
+			r.Unknown = append(r.Unknown, RawField{
+				Type:  dataType,
+				Value: binary.LittleEndian.Uint16(rest),
+			})
+			r.Fields = append(r.Fields, fmt.Sprintf("0x%02x", dataType))
+			rest = rest[unknownFieldLen:]
+			r.Undecoded += fieldLen - len(rest)
+		}
+	}
+
+	return r, nil, nil
+}
+
+// fieldName returns the name of a field type as used in Fields, with
+// unknown types in hex.
+func fieldName(dataType byte) string {
+	if name := fieldTypeName(dataType); name != "unknown" {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", dataType)
+}
+
+// String returns the reading in the format used for log messages.
+func (r Reading) String() string {
+	var str strings.Builder
+	fmt.Fprintf(&str, "batt:%d%%", r.Battery)
+	if l := r.Light; l != nil {
+		fmt.Fprintf(&str, " light:%v/%d/%d/%d", l.IR, l.Resolution, l.Range, l.Value)
+	}
+	if r.Temperature != nil {
+		fmt.Fprintf(&str, " temp:%s", display.temp(*r.Temperature))
+	}
+	if r.RawTemperature != nil {
+		fmt.Fprintf(&str, " raw:%s", display.temp(*r.RawTemperature))
+	}
+	for _, t := range r.Probes {
+		fmt.Fprintf(&str, " probe:%s", display.temp(t))
+	}
+	if r.Humidity != nil {
+		fmt.Fprintf(&str, " rh:%s", display.rh(*r.Humidity))
+	}
+	return str.String()
+}
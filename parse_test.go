@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseFixtures checks Parse against the hand-made advertisements in
+// testdata. They follow the format as implemented, so they catch
+// regressions but say nothing about how closely parse matches real
+// devices.
+func TestParseFixtures(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test data")
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".hex")
+		t.Run(name, func(t *testing.T) {
+			data := readHex(t, file)
+
+			bs, err := ioutil.ReadFile(strings.TrimSuffix(file, ".hex") + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected Reading
+			if err := json.Unmarshal(bs, &expected); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r, expected) {
+				t.Errorf("got %+v, expected %+v", r, expected)
+			}
+		})
+	}
+}
+
+// readHex returns the bytes of a file containing hex digits, ignoring
+// whitespace.
+func readHex(t *testing.T, file string) []byte {
+	t.Helper()
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hex.DecodeString(strings.Join(strings.Fields(string(bs)), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestIsSensorBug(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"nil", nil, false},
+		{"empty", []byte{}, false},
+		{"four bytes", []byte{0x85, 0x00, 0x02, 0x00}, false},
+		{"prefix only", []byte{0x85, 0x00, 0x02, 0x00, 0x3c}, false},
+		{"six bytes", []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a}, false},
+		{"seven bytes", []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00}, true},
+		{"with fields", []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00, 0x43, 0x58, 0x01}, true},
+		{"wrong company", []byte{0x86, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00}, false},
+		{"wrong product", []byte{0x85, 0x00, 0x02, 0x00, 0x3d, 0x5a, 0x00}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if ok := isSensorBug(tc.data); ok != tc.ok {
+				t.Errorf("isSensorBug(%x) = %v, expected %v", tc.data, ok, tc.ok)
+			}
+			if _, err := Parse(tc.data); (err != errNoMatch) != tc.ok {
+				t.Errorf("Parse(%x) error = %v, expected match %v", tc.data, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestParseLightLength(t *testing.T) {
+	header := []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00}
+	// Each light field is followed by a temperature field of 20°C, to
+	// verify that the parser resumes at the right offset.
+	temp := []byte{0x43, 0x40, 0x01}
+
+	cases := []struct {
+		name  string
+		field []byte
+		light *Light
+		err   error
+	}{
+		{"no data", []byte{0x42, 0b0_0_01_10_00}, nil, nil},
+		{"one byte", []byte{0x42, 0b0_0_01_10_01, 0x7f}, &Light{Resolution: 1, Range: 2, Value: 0x7f}, nil},
+		{"two bytes", []byte{0x42, 0b1_0_00_01_10, 0x2c, 0x01}, &Light{IR: true, Range: 1, Value: 300}, nil},
+		{"three bytes", []byte{0x42, 0b0_0_00_00_11, 0x01, 0x02, 0x03}, nil, errLightLength},
+		{"truncated", []byte{0x42, 0b0_0_00_00_10, 0x2c}, nil, errTruncated},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data []byte
+			data = append(data, header...)
+			data = append(data, tc.field...)
+			if tc.err != errTruncated {
+				data = append(data, temp...)
+			}
+
+			r, err := Parse(data)
+			if err != tc.err {
+				t.Fatalf("got error %v, expected %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(r.Light, tc.light) {
+				t.Errorf("got light %+v, expected %+v", r.Light, tc.light)
+			}
+			if r.Temperature == nil || *r.Temperature != 20 {
+				t.Errorf("temperature not parsed after light field: %+v", r)
+			}
+		})
+	}
+}
+
+func TestParseTemperatureScale(t *testing.T) {
+	header := []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00}
+
+	cases := []struct {
+		raw  []byte
+		temp float64
+	}{
+		{[]byte{0x68, 0x01}, 22.5},      // 360 steps
+		{[]byte{0xb0, 0xff}, -5},        // -80 steps
+		{[]byte{0x00, 0x00}, 0},         // zero
+		{[]byte{0xff, 0x7f}, 2047.9375}, // largest positive value
+	}
+
+	for _, tc := range cases {
+		data := append(append(append([]byte{}, header...), 0x43), tc.raw...)
+		r, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Temperature == nil || *r.Temperature != tc.temp {
+			t.Errorf("raw %x: got %+v, expected temperature %v", tc.raw, r, tc.temp)
+		}
+	}
+}
+
+func TestParseAccel(t *testing.T) {
+	// An accelerometer field with an alert byte, followed by a
+	// temperature field of 20°C to verify the offset after it.
+	data := []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00, 0xc1, 0x01, 0x34, 0x12, 0x43, 0x40, 0x01}
+
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Accel == nil {
+		t.Fatal("accel field not parsed")
+	}
+	if *r.Accel != 0x1234 {
+		t.Errorf("got accel %#x, expected 0x1234", *r.Accel)
+	}
+	if r.Temperature == nil || *r.Temperature != 20 {
+		t.Errorf("temperature not parsed after accel field: %+v", r)
+	}
+
+	if _, err := Parse(data[:9]); err != errTruncated {
+		t.Errorf("got error %v for truncated accel field, expected %v", err, errTruncated)
+	}
+}
+
+func TestParseAlerts(t *testing.T) {
+	// A light field with an alert byte but no data, then a temperature
+	// field of 20°C with an alert byte, then humidity without one.
+	data := []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00, 0x82, 0x04, 0xc3, 0x02, 0x40, 0x01, 0x44, 0x10, 0x27}
+
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]byte{"light": 0x04, "temp": 0x02}
+	if !reflect.DeepEqual(r.Alerts, expected) {
+		t.Errorf("got alerts %v, expected %v", r.Alerts, expected)
+	}
+	if r.Temperature == nil || *r.Temperature != 20 || r.Humidity == nil || *r.Humidity != 100 {
+		t.Errorf("fields not parsed after alert bytes: %+v", r)
+	}
+
+	if _, err := Parse(data[:8]); err != errTruncated {
+		t.Errorf("got error %v for truncated alert byte, expected %v", err, errTruncated)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	// The same fields, a temperature of 20°C, with the known format and
+	// an unknown one. Both decode the same, only Format differs.
+	known := []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x00, 0x43, 0x40, 0x01}
+	unknown := []byte{0x85, 0x00, 0x02, 0x00, 0x3c, 0x5a, 0x07, 0x43, 0x40, 0x01}
+
+	r, err := Parse(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Format != 0 || r.Temperature == nil || *r.Temperature != 20 {
+		t.Errorf("known format: got %+v", r)
+	}
+
+	r, err = Parse(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Format != 7 || r.Battery != 90 || r.Temperature == nil || *r.Temperature != 20 {
+		t.Errorf("unknown format: got %+v", r)
+	}
+}
+
+func TestLightLux(t *testing.T) {
+	cases := []struct {
+		light Light
+		lux   float64
+		ok    bool
+	}{
+		// 16 bit resolution over 1000 lux
+		{Light{Resolution: 0, Range: 0, Value: 65535}, 1000 * 65535.0 / 65536, true},
+		{Light{Resolution: 0, Range: 0, Value: 32768}, 500, true},
+		// 12 bit resolution over 4000 lux
+		{Light{Resolution: 1, Range: 1, Value: 1024}, 1000, true},
+		// 8 bit resolution over 16000 lux
+		{Light{Resolution: 2, Range: 2, Value: 16}, 1000, true},
+		// 4 bit resolution over 64000 lux
+		{Light{Resolution: 3, Range: 3, Value: 8}, 32000, true},
+		// 8 bit resolution over 1000 lux
+		{Light{Resolution: 2, Range: 0, Value: 128}, 500, true},
+		{Light{Resolution: 0, Range: 0, Value: 0}, 0, true},
+		// IR counts have no lux value
+		{Light{IR: true, Resolution: 0, Range: 0, Value: 100}, 0, false},
+	}
+
+	for _, tc := range cases {
+		lux, ok := tc.light.Lux()
+		if ok != tc.ok || lux != tc.lux {
+			t.Errorf("%+v: got %v, %v, expected %v, %v", tc.light, lux, ok, tc.lux, tc.ok)
+		}
+	}
+}
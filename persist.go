@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// savedState is the on disk form of the per-device state.
+type savedState struct {
+	Devices map[string]savedDevice `json:"devices"`
+}
+
+type savedDevice struct {
+	FirstSeen time.Time      `json:"firstSeen"`
+	LastSeen  time.Time      `json:"lastSeen"`
+	Reading   Reading        `json:"reading"`
+	RSSI      int            `json:"rssi"`
+	Seq       uint64         `json:"seq"`
+	Fields    []string       `json:"fields"`
+	Temp      *savedTemp     `json:"temperatureStats,omitempty"`
+	Battery   []savedBattery `json:"battery,omitempty"`
+}
+
+type savedTemp struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+	Count int     `json:"count"`
+}
+
+type savedBattery struct {
+	When    time.Time `json:"when"`
+	Percent float64   `json:"percent"`
+}
+
+// snapshot returns the per-device state in its saved form.
+func (s *state) snapshot() savedState {
+	saved := savedState{Devices: make(map[string]savedDevice, len(s.updates))}
+	for id, cur := range s.updates {
+		dev := savedDevice{
+			FirstSeen: cur.firstSeen,
+			LastSeen:  cur.lastSeen,
+			Reading:   cur.reading,
+			RSSI:      cur.rssi,
+			Seq:       cur.seq,
+		}
+		for f := range cur.fields {
+			dev.Fields = append(dev.Fields, f)
+		}
+		sort.Strings(dev.Fields)
+		if t := cur.temp; t.count > 0 {
+			dev.Temp = &savedTemp{Min: t.min, Max: t.max, Sum: t.sum, Count: t.count}
+		}
+		for _, b := range cur.battery.ordered() {
+			dev.Battery = append(dev.Battery, savedBattery{When: b.when, Percent: b.percent})
+		}
+		saved.Devices[id] = dev
+	}
+	return saved
+}
+
+// restore loads saved per-device state and sets the gauges to the last
+// known values. With -max-devices, only the devices seen most recently
+// are restored.
+func (s *state) restore(saved savedState) {
+	ids := make([]string, 0, len(saved.Devices))
+	for id := range saved.Devices {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return saved.Devices[ids[i]].LastSeen.After(saved.Devices[ids[j]].LastSeen)
+	})
+	if max := s.cfg.maxDevices; max > 0 && len(ids) > max {
+		log.Printf("Warning: device limit (%d) reached, not restoring %d devices seen less recently\n", max, len(ids)-max)
+		ids = ids[:max]
+	}
+	for _, id := range ids {
+		dev := saved.Devices[id]
+		cur := &update{
+			message:   s.formatMessage(id, dev.Reading),
+			firstSeen: dev.FirstSeen,
+			lastSeen:  dev.LastSeen,
+			reading:   dev.Reading,
+			rssi:      dev.RSSI,
+			seq:       dev.Seq,
+			fields:    make(map[string]bool),
+		}
+		if dev.Reading.Temperature != nil {
+			cur.lastTemp = dev.LastSeen
+		}
+		if cur.firstSeen.IsZero() {
+			// Saved before first seen times were recorded; the last
+			// seen time is the best bound we have.
+			cur.firstSeen = dev.LastSeen
+		}
+		firstSeen.WithLabelValues(id).Set(float64(cur.firstSeen.Unix()))
+		for _, f := range dev.Fields {
+			cur.fields[f] = true
+			fieldInfo.WithLabelValues(id, f).Set(1)
+		}
+		if t := dev.Temp; t != nil {
+			cur.temp = tempStats{min: t.Min, max: t.Max, sum: t.Sum, count: t.Count}
+			airTempMin.WithLabelValues(id).Set(t.Min)
+			airTempMax.WithLabelValues(id).Set(t.Max)
+		}
+		for _, b := range dev.Battery {
+			cur.battery.add(b.When, b.Percent)
+		}
+		if rate, ok := cur.battery.ratePerDay(); ok {
+			batteryRate.WithLabelValues(id).Set(rate)
+		}
+		if dev.Reading.Light != nil {
+			cur.setLightInfo(id, dev.Reading.Light)
+		}
+		cur.status = s.cfg.devices[id].status(dev.Reading)
+		s.updates[id] = cur
+		s.setMetrics(id, dev.Reading)
+	}
+}
+
+func loadState(path string) (savedState, error) {
+	var saved savedState
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return saved, err
+	}
+	err = json.Unmarshal(bs, &saved)
+	return saved, err
+}
+
+// saveState writes the state to a temporary file and renames it into
+// place, so that a crash or power loss never leaves a partial file.
+func saveState(path string, saved savedState) error {
+	bs, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, bs)
+}
+
+// writeFileAtomic writes the data to a temporary file next to path, syncs
+// it and renames it into place. The file keeps the permissions of the one
+// it replaces, or gets 0644 if it's new.
+func writeFileAtomic(path string, bs []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "btl",
+	Name:      "rate_limited_total",
+	Help:      "Advertisements dropped for exceeding the -rate-limit (scope=\"global\") or -rate-limit-device (scope=\"device\") rate.",
+}, []string{"scope"})
+
+// rateLimiter caps the rate of advertisements processed, in total and per
+// device, as a guard against a device flooding us. It is a token bucket
+// holding up to a second's worth of advertisements, and at least one so
+// that rates below one per second admit anything at all. A zero rate is
+// no limit.
+type rateLimiter struct {
+	global, perDevice float64 // per second
+	all               tokenBucket
+	devices           map[string]*tokenBucket
+}
+
+func newRateLimiter(global, perDevice float64) *rateLimiter {
+	return &rateLimiter{
+		global:    global,
+		perDevice: perDevice,
+		devices:   make(map[string]*tokenBucket),
+	}
+}
+
+// allow reports whether an advertisement from the device may be
+// processed, counting it as rate limited if not. Advertisements dropped by
+// the device limit don't count against the global one.
+func (l *rateLimiter) allow(id string, now time.Time) bool {
+	if l.perDevice > 0 {
+		b, ok := l.devices[id]
+		if !ok {
+			b = new(tokenBucket)
+			l.devices[id] = b
+		}
+		if !b.take(now, l.perDevice) {
+			rateLimited.WithLabelValues("device").Inc()
+			return false
+		}
+	}
+	if l.global > 0 && !l.all.take(now, l.global) {
+		rateLimited.WithLabelValues("global").Inc()
+		return false
+	}
+	return true
+}
+
+// expire forgets the buckets of devices not seen for long enough that
+// they are full again anyway: a second, or longer for rates below one per
+// second.
+func (l *rateLimiter) expire(now time.Time) {
+	full := time.Second
+	if l.perDevice > 0 && l.perDevice < 1 {
+		full = time.Duration(float64(time.Second) / l.perDevice)
+	}
+	for id, b := range l.devices {
+		if now.Sub(b.last) >= full {
+			delete(l.devices, id)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket at the given rate per second, up to a second's
+// worth or one token, whichever is more, and takes a token if there is
+// one.
+func (b *tokenBucket) take(now time.Time, rate float64) bool {
+	max := rate
+	if max < 1 {
+		max = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = max
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
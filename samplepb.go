@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// sampleEncoding is how a sink serializes samples.
+type sampleEncoding int
+
+const (
+	encodingJSON sampleEncoding = iota
+	encodingProtobuf
+)
+
+func parseSampleEncoding(s string) (sampleEncoding, error) {
+	switch s {
+	case "json":
+		return encodingJSON, nil
+	case "protobuf":
+		return encodingProtobuf, nil
+	default:
+		return 0, fmt.Errorf("unknown encoding %q", s)
+	}
+}
+
+// marshal returns the sample in the encoding.
+func (e sampleEncoding) marshal(s Sample) ([]byte, error) {
+	if e == encodingProtobuf {
+		return encodeSample(s), nil
+	}
+	return json.Marshal(s)
+}
+
+// The protobuf encoding of a sample follows this schema, which consumers
+// can compile to decode it. Unset optional values are left out, as in the
+// JSON encoding.
+//
+//	syntax = "proto3";
+//
+//	message Sample {
+//	  string device = 1;
+//	  string name = 2;
+//	  string gateway = 3;
+//	  int64 time_unix_nano = 4;
+//	  uint64 seq = 5;
+//	  Reading reading = 6;
+//	}
+//
+//	message Reading {
+//	  repeated string fields = 1;
+//	  uint32 battery = 2;
+//	  uint32 format = 3;
+//	  optional double temperature = 4;
+//	  optional double raw_temperature = 5;
+//	  Light light = 6;
+//	  optional double humidity = 7;
+//	  repeated double probes = 8;
+//	  optional uint32 accel = 9;
+//	  repeated RawField unknown = 10;
+//	  map<string, uint32> alerts = 11;
+//	  uint32 undecoded = 12;
+//	}
+//
+//	message Light {
+//	  bool ir = 1;
+//	  uint32 resolution = 2;
+//	  uint32 range = 3;
+//	  uint32 value = 4;
+//	}
+//
+//	message RawField {
+//	  uint32 type = 1;
+//	  uint32 value = 2;
+//	}
+
+// encodeSample returns the protobuf encoding of the sample.
+func encodeSample(s Sample) []byte {
+	var b []byte
+	b = appendString(b, 1, s.Device)
+	b = appendString(b, 2, s.Name)
+	b = appendString(b, 3, s.Gateway)
+	if !s.Time.IsZero() {
+		b = appendVarint(b, 4, uint64(s.Time.UnixNano()))
+	}
+	b = appendVarint(b, 5, s.Seq)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	return protowire.AppendBytes(b, encodeReading(s.Reading))
+}
+
+func encodeReading(r Reading) []byte {
+	var b []byte
+	for _, f := range r.Fields {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, f)
+	}
+	b = appendVarint(b, 2, uint64(r.Battery))
+	b = appendVarint(b, 3, uint64(r.Format))
+	b = appendDouble(b, 4, r.Temperature)
+	b = appendDouble(b, 5, r.RawTemperature)
+	if l := r.Light; l != nil {
+		var lb []byte
+		if l.IR {
+			lb = appendVarint(lb, 1, 1)
+		}
+		lb = appendVarint(lb, 2, uint64(l.Resolution))
+		lb = appendVarint(lb, 3, uint64(l.Range))
+		lb = appendVarint(lb, 4, uint64(l.Value))
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	b = appendDouble(b, 7, r.Humidity)
+	if len(r.Probes) > 0 {
+		var pb []byte
+		for _, p := range r.Probes {
+			pb = protowire.AppendFixed64(pb, math.Float64bits(p))
+		}
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, pb)
+	}
+	if r.Accel != nil {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*r.Accel))
+	}
+	for _, u := range r.Unknown {
+		var ub []byte
+		ub = appendVarint(ub, 1, uint64(u.Type))
+		ub = appendVarint(ub, 2, uint64(u.Value))
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendBytes(b, ub)
+	}
+	for k, v := range r.Alerts {
+		var eb []byte
+		eb = appendString(eb, 1, k)
+		eb = appendVarint(eb, 2, uint64(v))
+		b = protowire.AppendTag(b, 11, protowire.BytesType)
+		b = protowire.AppendBytes(b, eb)
+	}
+	return appendVarint(b, 12, uint64(r.Undecoded))
+}
+
+// appendString appends a string field, unless it is empty.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendVarint appends a varint field, unless it is zero.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendDouble appends a double field, unless it is nil.
+func appendDouble(b []byte, num protowire.Number, v *float64) []byte {
+	if v == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(*v))
+}
+
+var errProtobuf = errors.New("malformed protobuf sample")
+
+// decodeSample decodes the protobuf encoding of a sample, for consumers
+// written in Go and for testing. Unknown fields are skipped.
+func decodeSample(b []byte) (Sample, error) {
+	var s Sample
+	err := decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			s.Device = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			s.Name = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			s.Gateway = string(v)
+		case num == 4 && typ == protowire.VarintType:
+			s.Time = time.Unix(0, int64(n))
+		case num == 5 && typ == protowire.VarintType:
+			s.Seq = n
+		case num == 6 && typ == protowire.BytesType:
+			r, err := decodeReading(v)
+			if err != nil {
+				return err
+			}
+			s.Reading = r
+		}
+		return nil
+	})
+	return s, err
+}
+
+func decodeReading(b []byte) (Reading, error) {
+	var r Reading
+	err := decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			r.Fields = append(r.Fields, string(v))
+		case num == 2 && typ == protowire.VarintType:
+			r.Battery = int(n)
+		case num == 3 && typ == protowire.VarintType:
+			r.Format = byte(n)
+		case num == 4 && typ == protowire.Fixed64Type:
+			r.Temperature = float64Ptr(n)
+		case num == 5 && typ == protowire.Fixed64Type:
+			r.RawTemperature = float64Ptr(n)
+		case num == 6 && typ == protowire.BytesType:
+			l := new(Light)
+			err := decodeFields(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				if typ != protowire.VarintType {
+					return nil
+				}
+				switch num {
+				case 1:
+					l.IR = n != 0
+				case 2:
+					l.Resolution = int(n)
+				case 3:
+					l.Range = int(n)
+				case 4:
+					l.Value = uint16(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			r.Light = l
+		case num == 7 && typ == protowire.Fixed64Type:
+			r.Humidity = float64Ptr(n)
+		case num == 8 && typ == protowire.Fixed64Type:
+			r.Probes = append(r.Probes, math.Float64frombits(n))
+		case num == 8 && typ == protowire.BytesType:
+			// Packed
+			for len(v) > 0 {
+				p, m := protowire.ConsumeFixed64(v)
+				if m < 0 {
+					return errProtobuf
+				}
+				r.Probes = append(r.Probes, math.Float64frombits(p))
+				v = v[m:]
+			}
+		case num == 9 && typ == protowire.VarintType:
+			a := uint16(n)
+			r.Accel = &a
+		case num == 10 && typ == protowire.BytesType:
+			var u RawField
+			err := decodeFields(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					u.Type = byte(n)
+				case num == 2 && typ == protowire.VarintType:
+					u.Value = uint16(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			r.Unknown = append(r.Unknown, u)
+		case num == 11 && typ == protowire.BytesType:
+			var key string
+			var val byte
+			err := decodeFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					key = string(v)
+				case num == 2 && typ == protowire.VarintType:
+					val = byte(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if r.Alerts == nil {
+				r.Alerts = make(map[string]byte)
+			}
+			r.Alerts[key] = val
+		case num == 12 && typ == protowire.VarintType:
+			r.Undecoded = int(n)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// decodeFields calls fn for each field in the message, with the contents
+// of length delimited fields in v and the value of varint and fixed
+// fields in n.
+func decodeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, m := protowire.ConsumeTag(b)
+		if m < 0 {
+			return errProtobuf
+		}
+		b = b[m:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, m = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			n, m = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, m = protowire.ConsumeBytes(b)
+		default:
+			m = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if m < 0 {
+			return errProtobuf
+		}
+		b = b[m:]
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func float64Ptr(bits uint64) *float64 {
+	v := math.Float64frombits(bits)
+	return &v
+}
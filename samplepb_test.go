@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSampleProtobufRoundTrip(t *testing.T) {
+	temp, raw, rh := 21.5, 21.25, 45.0
+	accel := uint16(0x1234)
+	samples := []Sample{
+		{Device: "00:00:00:00:00:01", Reading: Reading{Fields: []string{"battery"}, Battery: 100}},
+		{
+			Device:  "00:00:00:00:00:02",
+			Name:    "kitchen",
+			Gateway: "pi",
+			Time:    time.Unix(1600000000, 123456789),
+			Seq:     42,
+			Reading: Reading{
+				Fields:         []string{"battery", "light", "temp", "temp", "humidity", "accel", "0x05"},
+				Battery:        75,
+				Format:         0,
+				Temperature:    &temp,
+				RawTemperature: &raw,
+				Light:          &Light{IR: true, Resolution: 2, Range: 1, Value: 300},
+				Humidity:       &rh,
+				Probes:         []float64{-4.5, 0},
+				Accel:          &accel,
+				Unknown:        []RawField{{Type: 0x05, Value: 7}},
+				Alerts:         map[string]byte{"temp": 1, "light": 0},
+				Undecoded:      3,
+			},
+		},
+	}
+
+	for _, s := range samples {
+		got, err := decodeSample(encodeSample(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Time.Equal(s.Time) {
+			t.Errorf("got time %v, expected %v", got.Time, s.Time)
+		}
+		got.Time = s.Time
+		if !reflect.DeepEqual(got, s) {
+			g, _ := json.Marshal(got)
+			e, _ := json.Marshal(s)
+			t.Errorf("round trip:\ngot      %s\nexpected %s", g, e)
+		}
+	}
+}
+
+func TestSampleProtobufMalformed(t *testing.T) {
+	b := encodeSample(Sample{Device: "00:00:00:00:00:01", Reading: Reading{Battery: 90}})
+	// Cut inside the device string, inside the reading, and a lone
+	// continued varint.
+	for _, bad := range [][]byte{b[:5], b[:len(b)-1], {0xff}} {
+		if _, err := decodeSample(bad); err != errProtobuf {
+			t.Errorf("%x: got error %v, expected %v", bad, err, errProtobuf)
+		}
+	}
+}
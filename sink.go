@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sinkQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "sink",
+		Name:      "queue_depth",
+		Help:      "Number of samples waiting to be published, per sink.",
+	}, []string{"sink"})
+	sinkDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Subsystem: "sink",
+		Name:      "dropped_total",
+		Help:      "Samples dropped because the sink queue was full, per sink.",
+	}, []string{"sink"})
+)
+
+// A Sink receives every sample as it is decoded. Flush is called once on
+// shutdown, after the last Publish, and should send anything the sink has
+// buffered before the context is done.
+type Sink interface {
+	Publish(Sample) error
+	Flush(ctx context.Context) error
+}
+
+// A Sample is a reading from a given device at a given time.
+type Sample struct {
+	Device  string    `json:"device"`
+	Name    string    `json:"name,omitempty"`
+	Gateway string    `json:"gateway,omitempty"`
+	Time    time.Time `json:"time"`
+	// Seq counts the samples published for the device, starting at one,
+	// so that consumers can detect gaps and reordering. It carries on
+	// across restarts when a state file is used.
+	Seq uint64 `json:"seq"`
+	Reading
+}
+
+// sinkNames are the names sinks are registered under, as used in the sinks
+// section of the config file.
+var sinkNames = []string{"aws-iot", "azure-iot", "fifo", "loki", "mqtt", "opentsdb"}
+
+// sinkQueue is a bounded queue of samples for a sink, consumed by one or
+// more worker goroutines so that a slow sink never holds up discovery or
+// the other sinks.
+type sinkQueue struct {
+	name   string
+	sink   Sink
+	filter sampleFilter
+	queue  chan Sample
+	wg     sync.WaitGroup // running workers
+}
+
+// addSink registers a sink with its own queue and the filter configured
+// for it, if any. The queues are started by startSinks.
+func (s *state) addSink(name string, sink Sink) {
+	s.sinks = append(s.sinks, &sinkQueue{
+		name:   name,
+		sink:   sink,
+		filter: s.cfg.sinkFilters[name],
+		queue:  make(chan Sample, s.cfg.sinkQueue),
+	})
+}
+
+// startSinks starts the sink workers, spreading the given number of
+// workers over the sinks with at least one each; the first sinks get one
+// more when they don't divide evenly. With workers zero or less, each sink
+// gets one worker. Samples for a sink with several workers may be
+// published out of order.
+func (s *state) startSinks(workers int) {
+	perSink, extra := 1, 0
+	if len(s.sinks) > 0 && workers > len(s.sinks) {
+		perSink, extra = workers/len(s.sinks), workers%len(s.sinks)
+	}
+	for i, q := range s.sinks {
+		n := perSink
+		if i < extra {
+			n++
+		}
+		for j := 0; j < n; j++ {
+			q.wg.Add(1)
+			go q.run()
+		}
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer q.wg.Done()
+	for sample := range q.queue {
+		sinkQueueDepth.WithLabelValues(q.name).Set(float64(len(q.queue)))
+		if err := q.sink.Publish(sample); err != nil {
+			log.Printf("%s: publish to %s: %v\n", sample.Device, q.name, err)
+		}
+	}
+}
+
+func (s *state) publish(sample Sample) {
+	for _, q := range s.sinks {
+		sample, ok := q.filter.apply(sample)
+		if !ok {
+			continue
+		}
+		select {
+		case q.queue <- sample:
+			sinkQueueDepth.WithLabelValues(q.name).Set(float64(len(q.queue)))
+		default:
+			sinkDropped.WithLabelValues(q.name).Inc()
+		}
+	}
+}
+
+// drainSinks stops accepting samples, waits for the sinks to publish what
+// is queued and flushes them, giving up when the context is done. It must
+// not be called concurrently with publish.
+func (s *state) drainSinks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, q := range s.sinks {
+		wg.Add(1)
+		go func(q *sinkQueue) {
+			defer wg.Done()
+			if err := q.drain(ctx); err != nil {
+				log.Printf("Draining %s: %v\n", q.name, err)
+			}
+		}(q)
+	}
+	wg.Wait()
+}
+
+func (q *sinkQueue) drain(ctx context.Context) error {
+	close(q.queue)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("%d samples not published: %w", len(q.queue), ctx.Err())
+	}
+	return q.sink.Flush(ctx)
+}
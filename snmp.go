@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SNMP agent serves a read only table of the tracked devices to SNMP
+// v2c GET, GETNEXT and GETBULK requests. Under the base OID (-snmp-oid,
+// by default in the Net-SNMP experimental subtree) the table is
+//
+//	<base>.1.1.<column>.<index>
+//
+// with one row per device, indexed from 1 in device ID order, and the
+// columns
+//
+//	1  btlDeviceID           OCTET STRING   device ID
+//	2  btlDeviceName         OCTET STRING   friendly name, if any
+//	3  btlDeviceTemperature  INTEGER        temperature in 0.01 °C
+//	4  btlDeviceHumidity     Gauge32        relative humidity in 0.01 %
+//	5  btlDeviceBattery      Gauge32        battery level in %
+//	6  btlDeviceAge          Gauge32        seconds since last seen
+//
+// Cells for values the device doesn't send are absent. A device's index
+// changes when a device with a lower ID is added, so pollers should match
+// rows on btlDeviceID.
+
+// snmpDefaultOID is the Net-SNMP "netSnmpPlaypen" subtree, set aside for
+// experimental use, rather than an enterprise number of our own.
+const snmpDefaultOID = "1.3.6.1.4.1.8072.9999.9999.1"
+
+// snmpMaxVarBinds limits the size of a response to a GETBULK request.
+const snmpMaxVarBinds = 64
+
+// BER tags used by SNMP.
+const (
+	berInteger      = 0x02
+	berOctetString  = 0x04
+	berOID          = 0x06
+	berSequence     = 0x30
+	berGauge32      = 0x42
+	snmpGet         = 0xa0
+	snmpGetNext     = 0xa1
+	snmpResponse    = 0xa2
+	snmpGetBulk     = 0xa5
+	snmpNoSuchObj   = 0x80
+	snmpNoSuchInst  = 0x81
+	snmpEndOfMib    = 0x82
+	snmpVersion2c   = 1
+	snmpErrTooBig   = 1
+	snmpMaxDatagram = 65507
+)
+
+var errBER = errors.New("malformed BER encoding")
+
+type oid []int
+
+func parseOID(s string) (oid, error) {
+	var o oid
+	for _, part := range strings.Split(strings.Trim(s, "."), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		o = append(o, n)
+	}
+	if len(o) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return o, nil
+}
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare returns -1, 0 or 1 as o sorts before, equal to or after p.
+func (o oid) compare(p oid) int {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		if o[i] != p[i] {
+			if o[i] < p[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(p):
+		return -1
+	case len(o) > len(p):
+		return 1
+	}
+	return 0
+}
+
+func (o oid) append(ns ...int) oid {
+	return append(append(oid{}, o...), ns...)
+}
+
+// snmpVar is an OID and its BER encoded value.
+type snmpVar struct {
+	oid   oid
+	value []byte
+}
+
+// snmpTable returns the device table, sorted by OID.
+func (s *state) snmpTable(base oid, now time.Time) []snmpVar {
+	ids := make([]string, 0, len(s.updates))
+	for id := range s.updates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	entry := base.append(1, 1)
+	var vars []snmpVar
+	add := func(col, index int, value []byte) {
+		vars = append(vars, snmpVar{entry.append(col, index), value})
+	}
+	for i, id := range ids {
+		add(1, i+1, berEncode(berOctetString, []byte(id)))
+	}
+	for i, id := range ids {
+		if name := s.name(id); name != "" {
+			add(2, i+1, berEncode(berOctetString, []byte(name)))
+		}
+	}
+	for i, id := range ids {
+		if t := s.updates[id].reading.Temperature; t != nil {
+			add(3, i+1, berInt(berInteger, int64(math.Round(*t*100))))
+		}
+	}
+	for i, id := range ids {
+		if h := s.updates[id].reading.Humidity; h != nil {
+			add(4, i+1, berInt(berGauge32, int64(math.Round(*h*100))))
+		}
+	}
+	for i, id := range ids {
+		add(5, i+1, berInt(berGauge32, int64(s.updates[id].reading.Battery)))
+	}
+	for i, id := range ids {
+		add(6, i+1, berInt(berGauge32, int64(now.Sub(s.updates[id].lastSeen)/time.Second)))
+	}
+	return vars
+}
+
+// serveSNMP answers SNMP requests on the connection until it is closed.
+func (s *state) serveSNMP(conn net.PacketConn, community string, base oid) {
+	buf := make([]byte, snmpMaxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("SNMP:", err)
+			return
+		}
+		s.mut.Lock()
+		table := s.snmpTable(base, time.Now())
+		s.mut.Unlock()
+		resp, err := snmpHandle(buf[:n], community, table)
+		if err != nil {
+			// Malformed requests and wrong communities get no response,
+			// as with other agents
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Println("SNMP:", err)
+		}
+	}
+}
+
+// snmpHandle returns the response to a request, given the table to answer
+// from.
+func snmpHandle(req []byte, community string, table []snmpVar) ([]byte, error) {
+	tag, msg, _, err := berDecode(req)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	version, msg, err := berDecodeInt(msg)
+	if err != nil {
+		return nil, err
+	}
+	if version != snmpVersion2c {
+		return nil, fmt.Errorf("unsupported SNMP version %d", version)
+	}
+	tag, comm, msg, err := berDecode(msg)
+	if err != nil || tag != berOctetString {
+		return nil, errBER
+	}
+	if string(comm) != community {
+		return nil, errors.New("wrong community")
+	}
+	pduType, pdu, _, err := berDecode(msg)
+	if err != nil {
+		return nil, err
+	}
+	reqID, pdu, err := berDecodeInt(pdu)
+	if err != nil {
+		return nil, err
+	}
+	// For GETBULK these are the non-repeaters and max-repetitions
+	nonRep, pdu, err := berDecodeInt(pdu)
+	if err != nil {
+		return nil, err
+	}
+	maxRep, pdu, err := berDecodeInt(pdu)
+	if err != nil {
+		return nil, err
+	}
+	tag, list, _, err := berDecode(pdu)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	var oids []oid
+	for len(list) > 0 {
+		var vb []byte
+		tag, vb, list, err = berDecode(list)
+		if err != nil || tag != berSequence {
+			return nil, errBER
+		}
+		tag, enc, _, err := berDecode(vb)
+		if err != nil || tag != berOID {
+			return nil, errBER
+		}
+		o, err := berDecodeOID(enc)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, o)
+	}
+
+	var vars []snmpVar
+	switch pduType {
+	case snmpGet:
+		for _, o := range oids {
+			vars = append(vars, snmpGetExact(table, o))
+		}
+	case snmpGetNext:
+		for _, o := range oids {
+			vars = append(vars, snmpGetNextVar(table, o))
+		}
+	case snmpGetBulk:
+		if nonRep < 0 {
+			nonRep = 0
+		}
+		if nonRep > int64(len(oids)) {
+			nonRep = int64(len(oids))
+		}
+		for _, o := range oids[:nonRep] {
+			vars = append(vars, snmpGetNextVar(table, o))
+		}
+		repeaters := oids[nonRep:]
+		for r := int64(0); r < maxRep && len(repeaters) > 0 && len(vars) < snmpMaxVarBinds; r++ {
+			for i, o := range repeaters {
+				v := snmpGetNextVar(table, o)
+				vars = append(vars, v)
+				repeaters[i] = v.oid
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU type 0x%02x", pduType)
+	}
+
+	resp := snmpResponsePDU(comm, reqID, 0, 0, vars)
+	if len(resp) > snmpMaxDatagram {
+		resp = snmpResponsePDU(comm, reqID, snmpErrTooBig, 0, nil)
+	}
+	return resp, nil
+}
+
+func snmpGetExact(table []snmpVar, o oid) snmpVar {
+	i := sort.Search(len(table), func(i int) bool { return table[i].oid.compare(o) >= 0 })
+	if i < len(table) && table[i].oid.compare(o) == 0 {
+		return table[i]
+	}
+	sameColumn := func(j int) bool {
+		p := table[j].oid
+		return len(p) == len(o) && p[:len(p)-1].compare(o[:len(o)-1]) == 0
+	}
+	if i < len(table) && sameColumn(i) || i > 0 && sameColumn(i-1) {
+		// A column we have, but not this row
+		return snmpVar{o, berEncode(snmpNoSuchInst, nil)}
+	}
+	return snmpVar{o, berEncode(snmpNoSuchObj, nil)}
+}
+
+func snmpGetNextVar(table []snmpVar, o oid) snmpVar {
+	i := sort.Search(len(table), func(i int) bool { return table[i].oid.compare(o) > 0 })
+	if i < len(table) {
+		return table[i]
+	}
+	return snmpVar{o, berEncode(snmpEndOfMib, nil)}
+}
+
+func snmpResponsePDU(community []byte, reqID, errStatus, errIndex int64, vars []snmpVar) []byte {
+	var list []byte
+	for _, v := range vars {
+		list = append(list, berEncode(berSequence, append(berEncodeOID(v.oid), v.value...))...)
+	}
+	pdu := berInt(berInteger, reqID)
+	pdu = append(pdu, berInt(berInteger, errStatus)...)
+	pdu = append(pdu, berInt(berInteger, errIndex)...)
+	pdu = append(pdu, berEncode(berSequence, list)...)
+
+	msg := berInt(berInteger, snmpVersion2c)
+	msg = append(msg, berEncode(berOctetString, community)...)
+	msg = append(msg, berEncode(snmpResponse, pdu)...)
+	return berEncode(berSequence, msg)
+}
+
+// berDecode splits off the first TLV, returning its tag, contents and
+// what follows it.
+func berDecode(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBER
+	}
+	tag, l := b[0], int(b[1])
+	b = b[2:]
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 3 || len(b) < n {
+			return 0, nil, nil, errBER
+		}
+		l = 0
+		for _, c := range b[:n] {
+			l = l<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if len(b) < l {
+		return 0, nil, nil, errBER
+	}
+	return tag, b[:l], b[l:], nil
+}
+
+func berDecodeInt(b []byte) (int64, []byte, error) {
+	tag, c, rest, err := berDecode(b)
+	if err != nil || tag != berInteger || len(c) == 0 || len(c) > 8 {
+		return 0, nil, errBER
+	}
+	v := int64(int8(c[0]))
+	for _, x := range c[1:] {
+		v = v<<8 | int64(x)
+	}
+	return v, rest, nil
+}
+
+func berDecodeOID(c []byte) (oid, error) {
+	if len(c) == 0 {
+		return nil, errBER
+	}
+	o := oid{int(c[0]) / 40, int(c[0]) % 40}
+	n := 0
+	for i, x := range c[1:] {
+		if n > math.MaxInt32>>7 {
+			return nil, errBER
+		}
+		n = n<<7 | int(x&0x7f)
+		if x&0x80 == 0 {
+			o = append(o, n)
+			n = 0
+		} else if i == len(c)-2 {
+			return nil, errBER
+		}
+	}
+	return o, nil
+}
+
+func berEncode(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch l := len(content); {
+	case l < 0x80:
+		out = append(out, byte(l))
+	case l < 0x100:
+		out = append(out, 0x81, byte(l))
+	case l < 0x10000:
+		out = append(out, 0x82, byte(l>>8), byte(l))
+	default:
+		out = append(out, 0x83, byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(out, content...)
+}
+
+func berInt(tag byte, v int64) []byte {
+	var c []byte
+	for {
+		c = append([]byte{byte(v)}, c...)
+		v >>= 8
+		if (v == 0 && c[0]&0x80 == 0) || (v == -1 && c[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berEncode(tag, c)
+}
+
+func berEncodeOID(o oid) []byte {
+	c := []byte{byte(o[0]*40 + o[1])}
+	for _, n := range o[2:] {
+		var b []byte
+		b = append(b, byte(n&0x7f))
+		for n >>= 7; n > 0; n >>= 7 {
+			b = append([]byte{byte(n&0x7f | 0x80)}, b...)
+		}
+		c = append(c, b...)
+	}
+	return berEncode(berOID, c)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// snmpRequest returns an encoded v2c request for the OIDs.
+func snmpRequest(pduType byte, community string, reqID, nonRep, maxRep int64, oids ...oid) []byte {
+	var list []byte
+	for _, o := range oids {
+		list = append(list, berEncode(berSequence, append(berEncodeOID(o), 0x05, 0x00))...)
+	}
+	pdu := berInt(berInteger, reqID)
+	pdu = append(pdu, berInt(berInteger, nonRep)...)
+	pdu = append(pdu, berInt(berInteger, maxRep)...)
+	pdu = append(pdu, berEncode(berSequence, list)...)
+	msg := berInt(berInteger, snmpVersion2c)
+	msg = append(msg, berEncode(berOctetString, []byte(community))...)
+	msg = append(msg, berEncode(pduType, pdu)...)
+	return berEncode(berSequence, msg)
+}
+
+// snmpResponseVars decodes the variable bindings of a response.
+func snmpResponseVars(t *testing.T, resp []byte) []snmpVar {
+	t.Helper()
+	_, msg, _, err := berDecode(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg, _ = berDecodeInt(msg)
+	_, _, msg, _ = berDecode(msg)
+	tag, pdu, _, _ := berDecode(msg)
+	if tag != snmpResponse {
+		t.Fatalf("PDU type 0x%02x, expected a response", tag)
+	}
+	_, pdu, _ = berDecodeInt(pdu)
+	_, pdu, _ = berDecodeInt(pdu)
+	_, pdu, _ = berDecodeInt(pdu)
+	_, list, _, _ := berDecode(pdu)
+	var vars []snmpVar
+	for len(list) > 0 {
+		var vb []byte
+		_, vb, list, _ = berDecode(list)
+		_, enc, val, _ := berDecode(vb)
+		o, err := berDecodeOID(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars = append(vars, snmpVar{o, val})
+	}
+	return vars
+}
+
+func TestSNMP(t *testing.T) {
+	base := oid{1, 3, 6, 1, 4, 1, 8072, 9999, 9999, 1}
+	entry := base.append(1, 1)
+	table := []snmpVar{
+		{entry.append(1, 1), berEncode(berOctetString, []byte("a"))},
+		{entry.append(1, 2), berEncode(berOctetString, []byte("b"))},
+		{entry.append(3, 1), berInt(berInteger, -425)},
+		{entry.append(5, 1), berInt(berGauge32, 200)},
+	}
+
+	cases := []struct {
+		name     string
+		pduType  byte
+		nonRep   int64
+		maxRep   int64
+		oids     []oid
+		expected []snmpVar
+	}{
+		{"get", snmpGet, 0, 0, []oid{entry.append(3, 1)}, table[2:3]},
+		{"get no instance", snmpGet, 0, 0, []oid{entry.append(3, 2)}, []snmpVar{{entry.append(3, 2), []byte{snmpNoSuchInst, 0}}}},
+		{"get no object", snmpGet, 0, 0, []oid{base.append(2)}, []snmpVar{{base.append(2), []byte{snmpNoSuchObj, 0}}}},
+		{"getnext from base", snmpGetNext, 0, 0, []oid{base}, table[0:1]},
+		{"getnext across columns", snmpGetNext, 0, 0, []oid{entry.append(1, 2)}, table[2:3]},
+		{"getnext at end", snmpGetNext, 0, 0, []oid{entry.append(5, 1)}, []snmpVar{{entry.append(5, 1), []byte{snmpEndOfMib, 0}}}},
+		{"getbulk", snmpGetBulk, 0, 3, []oid{base}, table[0:3]},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := snmpHandle(snmpRequest(tc.pduType, "public", 42, tc.nonRep, tc.maxRep, tc.oids...), "public", table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vars := snmpResponseVars(t, resp)
+			if len(vars) != len(tc.expected) {
+				t.Fatalf("got %d variables, expected %d", len(vars), len(tc.expected))
+			}
+			for i := range vars {
+				if vars[i].oid.compare(tc.expected[i].oid) != 0 || !bytes.Equal(vars[i].value, tc.expected[i].value) {
+					t.Errorf("variable %d: got %v = %x, expected %v = %x", i, vars[i].oid, vars[i].value, tc.expected[i].oid, tc.expected[i].value)
+				}
+			}
+		})
+	}
+
+	if _, err := snmpHandle(snmpRequest(snmpGet, "private", 1, 0, 0, base), "public", table); err == nil {
+		t.Error("request with the wrong community was answered")
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 31, -1 << 31} {
+		got, rest, err := berDecodeInt(berInt(berInteger, v))
+		if err != nil || len(rest) != 0 || got != v {
+			t.Errorf("%d: round trip gave %d, %v", v, got, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import "fmt"
+
+// deviceStatus is a device's status from its latest temperature against
+// the configured ranges, exported as btl_sensorbug_status.
+type deviceStatus int
+
+const (
+	statusOK deviceStatus = iota
+	statusWarn
+	statusCritical
+)
+
+func (s deviceStatus) String() string {
+	switch s {
+	case statusOK:
+		return "ok"
+	case statusWarn:
+		return "warn"
+	case statusCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("deviceStatus(%d)", int(s))
+	}
+}
+
+func (s deviceStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// hasRanges returns true if any temperature range is configured, and so
+// the device has a status.
+func (d deviceConfig) hasRanges() bool {
+	return d.TempMin != nil || d.TempMax != nil || d.TempWarnMin != nil || d.TempWarnMax != nil
+}
+
+// status returns the status of a reading: critical outside tempMin and
+// tempMax, warn outside tempWarnMin and tempWarnMax, and otherwise ok. A
+// reading without a temperature is ok.
+func (d deviceConfig) status(r Reading) deviceStatus {
+	if r.Temperature == nil {
+		return statusOK
+	}
+	t := *r.Temperature
+	switch {
+	case outside(t, d.TempMin, d.TempMax):
+		return statusCritical
+	case outside(t, d.TempWarnMin, d.TempWarnMax):
+		return statusWarn
+	default:
+		return statusOK
+	}
+}
+
+func outside(v float64, min, max *float64) bool {
+	return min != nil && v < *min || max != nil && v > *max
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// textfileName is the file written in the -textfile directory.
+const textfileName = "btl.prom"
+
+// writeTextfiles periodically writes all metrics to btl.prom in dir, for
+// the node_exporter textfile collector. The file is written under a
+// temporary name and renamed into place, so the collector never reads a
+// partial file.
+func writeTextfiles(dir string, interval time.Duration, gatherer prometheus.Gatherer) {
+	path := filepath.Join(dir, textfileName)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := prometheus.WriteToTextfile(path, gatherer); err != nil {
+			log.Println("Textfile:", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	ansiClear = "\x1b[H\x1b[2J" // cursor home, clear screen
+	// tuiLogLines is the number of log lines shown below the table.
+	tuiLogLines = 5
+)
+
+// tuiLog receives the log output while the TUI has the terminal, keeping
+// the last few lines to show below the table.
+type tuiLog struct {
+	mut   sync.Mutex
+	lines []string
+}
+
+func (l *tuiLog) Write(p []byte) (int, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.lines = append(l.lines, strings.Split(strings.TrimRight(string(p), "\n"), "\n")...)
+	if len(l.lines) > tuiLogLines {
+		l.lines = append([]string(nil), l.lines[len(l.lines)-tuiLogLines:]...)
+	}
+	return len(p), nil
+}
+
+func (l *tuiLog) writeTo(w io.Writer) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if len(l.lines) > 0 {
+		fmt.Fprintf(w, "\n%s\n", strings.Join(l.lines, "\n"))
+	}
+}
+
+// tuiLogging is set, atomically, while the log output goes to a tuiLog.
+var tuiLogging int32
+
+// restoreLog hands the log output back to the terminal before a fatal
+// exit, as it would otherwise go to the TUI which is never redrawn.
+func restoreLog() {
+	if atomic.LoadInt32(&tuiLogging) != 0 {
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// fatalln is log.Fatalln for use once the TUI may have started.
+func fatalln(v ...interface{}) {
+	restoreLog()
+	log.Fatalln(v...)
+}
+
+// fatalf is log.Fatalf for use once the TUI may have started.
+func fatalf(format string, v ...interface{}) {
+	restoreLog()
+	log.Fatalf(format, v...)
+}
+
+// runTUI redraws a table of all tracked devices to w once per interval,
+// followed by the latest log lines, if any.
+func (s *state) runTUI(w io.Writer, interval time.Duration, logs *tuiLog) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var buf bytes.Buffer
+		buf.WriteString(ansiClear)
+		s.mut.Lock()
+		s.writeTable(&buf, time.Now())
+		s.mut.Unlock()
+		if logs != nil {
+			logs.writeTo(&buf)
+		}
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+func (s *state) writeTable(w io.Writer, now time.Time) {
+	ids := make([]string, 0, len(s.updates))
+	for id := range s.updates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "DEVICE\tNAME\tTEMP\tBATT\tRSSI\tAGE\n")
+	for _, id := range ids {
+		cur := s.updates[id]
+		temp := "-"
+		if t := cur.reading.Temperature; t != nil {
+			temp = display.temp(*t)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d%%\t%d\t%v\n", id, s.cfg.devices[id].Name, temp, cur.reading.Battery, cur.rssi, now.Sub(cur.lastSeen).Truncate(time.Second))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d devices, %s\n", len(ids), now.Format("15:04:05"))
+}
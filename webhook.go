@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhookCircuit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "btl",
+		Subsystem: "webhook",
+		Name:      "circuit_state",
+		Help:      "Webhook circuit breaker state: 0 closed, 1 open, 2 half-open.",
+	})
+	webhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "btl",
+		Subsystem: "webhook",
+		Name:      "events_total",
+		Help:      "Webhook events by result: sent, failed or dropped.",
+	}, []string{"result"})
+)
+
+// An alertEvent is posted as JSON to the webhook when a device changes
+// alert state.
+type alertEvent struct {
+	Event    string    `json:"event"`
+	Device   string    `json:"device"`
+	Name     string    `json:"name,omitempty"`
+	Time     time.Time `json:"time"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// webhook posts alert events to a URL from a worker goroutine, so that a
+// slow or failing endpoint never blocks the caller. Failed posts are
+// retried with exponential backoff, and a circuit breaker stops posting
+// altogether after repeated failures.
+type webhook struct {
+	url     string
+	client  *http.Client
+	queue   chan alertEvent
+	retries int
+	backoff time.Duration // initial retry delay, doubled for each retry
+	breaker breaker
+}
+
+func newWebhook(url string, queue, retries, failures int, cooldown time.Duration) *webhook {
+	w := &webhook{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan alertEvent, queue),
+		retries: retries,
+		backoff: time.Second,
+		breaker: breaker{threshold: failures, cooldown: cooldown},
+	}
+	go w.run()
+	return w
+}
+
+// notify queues an event for sending, dropping it if the queue is full.
+func (w *webhook) notify(ev alertEvent) {
+	select {
+	case w.queue <- ev:
+	default:
+		log.Printf("Webhook: queue full, dropping %s event for %s\n", ev.Event, ev.Device)
+		webhookEvents.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (w *webhook) run() {
+	for ev := range w.queue {
+		w.deliver(ev, time.Now())
+	}
+}
+
+// deliver sends the event unless the circuit is open at the given time,
+// and updates the circuit with the result.
+func (w *webhook) deliver(ev alertEvent, now time.Time) {
+	if !w.breaker.allow(now) {
+		webhookEvents.WithLabelValues("dropped").Inc()
+		return
+	}
+	if err := w.send(ev); err != nil {
+		log.Printf("Webhook: %s event for %s: %v\n", ev.Event, ev.Device, err)
+		webhookEvents.WithLabelValues("failed").Inc()
+		if w.breaker.failure(now) {
+			log.Printf("Webhook: circuit open after %d consecutive failures\n", w.breaker.failures)
+		}
+	} else {
+		webhookEvents.WithLabelValues("sent").Inc()
+		w.breaker.success()
+	}
+	webhookCircuit.Set(float64(w.breaker.state))
+}
+
+// send posts the event, retrying with backoff. A half-open circuit gets a
+// single attempt, and client errors other than 429 Too Many Requests are
+// not retried as they would only fail again.
+func (w *webhook) send(ev alertEvent) error {
+	bs, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	retries := w.retries
+	if w.breaker.state == breakerHalfOpen {
+		retries = 0
+	}
+	delay := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(bs)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		if se, ok := err.(statusError); ok && se.code < 500 && se.code != http.StatusTooManyRequests {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *webhook) post(bs []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// statusError is an unsuccessful HTTP response.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.status)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a simple circuit breaker. It opens after threshold
+// consecutive failures and half-opens after the cooldown, letting one
+// attempt through to decide whether to close again. It is not safe for
+// concurrent use.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	state     breakerState
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+func (b *breaker) success() {
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+// failure records a failed attempt and returns true if it caused the
+// circuit to open.
+func (b *breaker) failure(now time.Time) bool {
+	b.failures++
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+		return true
+	}
+	return false
+}
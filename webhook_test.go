@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testWebhook returns a webhook posting to a server that responds with
+// the status in *status, counting the requests in *requests. The worker
+// isn't started; events are handed to deliver directly.
+func testWebhook(t *testing.T, status, requests *int32, retries, failures int, cooldown time.Duration) *webhook {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	}))
+	t.Cleanup(srv.Close)
+	return &webhook{
+		url:     srv.URL,
+		client:  srv.Client(),
+		retries: retries,
+		backoff: time.Millisecond,
+		breaker: breaker{threshold: failures, cooldown: cooldown},
+	}
+}
+
+func TestWebhookBreaker(t *testing.T) {
+	status, requests := int32(http.StatusInternalServerError), int32(0)
+	w := testWebhook(t, &status, &requests, 2, 2, time.Minute)
+	ev := alertEvent{Event: "overdue", Device: "dev"}
+	t0 := time.Now()
+
+	// Each failing event is tried once and retried twice, and the second
+	// one opens the circuit.
+	w.deliver(ev, t0)
+	if requests != 3 || w.breaker.state != breakerClosed {
+		t.Fatalf("first failure: %d requests, state %d", requests, w.breaker.state)
+	}
+	w.deliver(ev, t0)
+	if requests != 6 || w.breaker.state != breakerOpen {
+		t.Fatalf("second failure: %d requests, state %d", requests, w.breaker.state)
+	}
+
+	// Nothing is sent while open.
+	w.deliver(ev, t0.Add(30*time.Second))
+	if requests != 6 {
+		t.Fatalf("open circuit: %d requests, expected 6", requests)
+	}
+
+	// After the cooldown a single probe is sent, and its failure opens
+	// the circuit again.
+	w.deliver(ev, t0.Add(2*time.Minute))
+	if requests != 7 || w.breaker.state != breakerOpen {
+		t.Fatalf("failed probe: %d requests, state %d", requests, w.breaker.state)
+	}
+
+	// A successful probe closes it.
+	atomic.StoreInt32(&status, http.StatusOK)
+	w.deliver(ev, t0.Add(4*time.Minute))
+	if requests != 8 || w.breaker.state != breakerClosed || w.breaker.failures != 0 {
+		t.Fatalf("successful probe: %d requests, state %d, %d failures", requests, w.breaker.state, w.breaker.failures)
+	}
+}
+
+func TestWebhookClientErrorNotRetried(t *testing.T) {
+	status, requests := int32(http.StatusBadRequest), int32(0)
+	w := testWebhook(t, &status, &requests, 3, 0, time.Minute)
+	w.deliver(alertEvent{Event: "overdue", Device: "dev"}, time.Now())
+	if requests != 1 {
+		t.Errorf("400 response: %d requests, expected 1", requests)
+	}
+
+	atomic.StoreInt32(&status, http.StatusTooManyRequests)
+	atomic.StoreInt32(&requests, 0)
+	w.deliver(alertEvent{Event: "overdue", Device: "dev"}, time.Now())
+	if requests != 4 {
+		t.Errorf("429 response: %d requests, expected 4", requests)
+	}
+}